@@ -1,3 +1,5 @@
+-- Monetary amounts are NUMERIC(15,3) so currencies with three minor unit digits (BHD, KWD) are stored exactly
+
 -- User table
 CREATE TABLE users
 (
@@ -6,6 +8,7 @@ CREATE TABLE users
     first_name VARCHAR(255),
     last_name VARCHAR(255),
     password VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'customer',
     active INT NOT NULL,
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL
@@ -22,6 +25,7 @@ CREATE TABLE billing_address
     postal_code VARCHAR(10),
     city VARCHAR(25),
     country VARCHAR(25),
+    vat_id VARCHAR(20) NOT NULL DEFAULT '',
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
@@ -36,7 +40,8 @@ CREATE TABLE plans
     billing_frequency INT NOT NULL,
     billing_frequency_units VARCHAR(20) NOT NULL,
     currency VARCHAR(5),
-    price NUMERIC(10,2) NOT NULL
+    price NUMERIC(15,3) NOT NULL,
+    trial_days INT NOT NULL DEFAULT 0
 );
 
 -- Subscription table
@@ -50,7 +55,7 @@ CREATE TABLE subscriptions
     duration_units VARCHAR(10) NOT NULL,
     billing_frequency INT NOT NULL,
     billing_frequency_units VARCHAR(20) NOT NULL,
-    price NUMERIC(10,2) NOT NULL,
+    price NUMERIC(15,3) NOT NULL,
     currency VARCHAR(3) NOT NULL,
     product_code VARCHAR(20) NOT NULL,
     status varchar(20) NOT NULL,
@@ -58,11 +63,193 @@ CREATE TABLE subscriptions
     next_billing_date TIMESTAMP NOT NULL,
     created_at TIMESTAMP,
     updated_at TIMESTAMP,
+    cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+    canceled_at TIMESTAMP,
+    skipped_cycles INT NOT NULL DEFAULT 0,
+    paused_cycles INT NOT NULL DEFAULT 0,
+    trial_ends_at TIMESTAMP,
+    trial_reminder_sent_at TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id),
     FOREIGN KEY (plan_id) REFERENCES plans(id),
     UNIQUE (user_id, plan_id, product_code)
 );
 
+-- Audit trail of subscription status transitions
+CREATE TABLE subscription_events
+(
+    id SERIAL PRIMARY KEY,
+    subscription_id INT NOT NULL,
+    action VARCHAR(30) NOT NULL,
+    from_status VARCHAR(20) NOT NULL,
+    to_status VARCHAR(20) NOT NULL,
+    actor_id INT,
+    detail VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (subscription_id) REFERENCES subscriptions(id),
+    FOREIGN KEY (actor_id) REFERENCES users(id)
+);
+
+
+-- Billing runs table
+CREATE TABLE billing_runs
+(
+    id SERIAL PRIMARY KEY,
+    job VARCHAR(20) NOT NULL,
+    trigger VARCHAR(20) NOT NULL,
+    period_from TIMESTAMP NOT NULL,
+    period_to TIMESTAMP NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    billed INT NOT NULL DEFAULT 0,
+    skipped INT NOT NULL DEFAULT 0,
+    failed INT NOT NULL DEFAULT 0,
+    started_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP
+);
+
+-- Invoices table
+CREATE TABLE invoices
+(
+    id SERIAL PRIMARY KEY,
+    invoice_number VARCHAR(50) NOT NULL UNIQUE,
+    kind VARCHAR(20) NOT NULL DEFAULT 'CYCLE',
+    subscription_id INT NOT NULL,
+    billing_run_id INT,
+    user_id INT NOT NULL,
+    period_start TIMESTAMP NOT NULL,
+    period_end TIMESTAMP NOT NULL,
+    invoice_date TIMESTAMP NOT NULL,
+    due_date TIMESTAMP NOT NULL,
+    subtotal NUMERIC(15,3) NOT NULL,
+    tax_total NUMERIC(15,3) NOT NULL DEFAULT 0,
+    total NUMERIC(15,3) NOT NULL,
+    tax_note TEXT NOT NULL DEFAULT '',
+    currency VARCHAR(3) NOT NULL,
+    -- the customer as billed, so that the PDF can be rendered again identically after address changes
+    billing_name VARCHAR(255) NOT NULL DEFAULT '',
+    billing_address VARCHAR(100) NOT NULL DEFAULT '',
+    billing_address_2 VARCHAR(100) NOT NULL DEFAULT '',
+    billing_postal_code VARCHAR(10) NOT NULL DEFAULT '',
+    billing_city VARCHAR(25) NOT NULL DEFAULT '',
+    billing_country VARCHAR(25) NOT NULL DEFAULT '',
+    billing_vat_id VARCHAR(20) NOT NULL DEFAULT '',
+    pdf_location VARCHAR(255) NOT NULL DEFAULT '',
+    pdf_checksum VARCHAR(64) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL CHECK (status IN ('DRAFT', 'ISSUED', 'SENT', 'PAID', 'VOID')),
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (subscription_id) REFERENCES subscriptions(id),
+    FOREIGN KEY (billing_run_id) REFERENCES billing_runs(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- A billing cycle is invoiced at most once; proration invoices may share a period start. Consolidated
+-- invoices are keyed by their first subscription, the others are guarded by their billed cycles.
+CREATE UNIQUE INDEX invoices_subscription_period_key ON invoices (subscription_id, period_start) WHERE kind = 'CYCLE';
+
+-- Invoice number counters, one gap-free sequence per calendar year
+CREATE TABLE invoice_number_sequences
+(
+    year INT PRIMARY KEY,
+    last_number INT NOT NULL
+);
+
+-- Invoice line items table
+CREATE TABLE invoice_line_items
+(
+    id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    subscription_id INT,
+    name VARCHAR(255) NOT NULL,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    unit_cost NUMERIC(15,3) NOT NULL,
+    quantity INT NOT NULL,
+    tax NUMERIC(5,2) NOT NULL DEFAULT 0,
+    tax_amount NUMERIC(15,3) NOT NULL DEFAULT 0,
+    discount NUMERIC(15,3) NOT NULL DEFAULT 0,
+    amount NUMERIC(15,3) NOT NULL,
+    FOREIGN KEY (invoice_id) REFERENCES invoices(id) ON DELETE CASCADE,
+    FOREIGN KEY (subscription_id) REFERENCES subscriptions(id)
+);
+
+
+-- Discount codes
+CREATE TABLE coupons
+(
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) NOT NULL UNIQUE,
+    kind VARCHAR(10) NOT NULL,
+    percent NUMERIC(5,2) NOT NULL DEFAULT 0,
+    amount NUMERIC(15,3) NOT NULL DEFAULT 0,
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    duration VARCHAR(10) NOT NULL,
+    duration_cycles INT NOT NULL DEFAULT 0,
+    max_redemptions INT NOT NULL DEFAULT 0,
+    times_redeemed INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- Coupons redeemed for subscriptions, at most one per subscription
+CREATE TABLE coupon_redemptions
+(
+    id SERIAL PRIMARY KEY,
+    coupon_id INT NOT NULL,
+    subscription_id INT NOT NULL,
+    redeemed_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (coupon_id) REFERENCES coupons(id),
+    FOREIGN KEY (subscription_id) REFERENCES subscriptions(id),
+    CONSTRAINT coupon_redemptions_subscription_key UNIQUE (subscription_id)
+);
+
+-- VAT rates per ISO 3166 country code. A row with a product code overrides the standard rate
+-- (empty product code) of that country for the product.
+CREATE TABLE tax_rates
+(
+    id SERIAL PRIMARY KEY,
+    country CHAR(2) NOT NULL,
+    product_code VARCHAR(20) NOT NULL DEFAULT '',
+    rate NUMERIC(5,2) NOT NULL,
+    UNIQUE (country, product_code)
+);
+
+INSERT INTO tax_rates (country, rate) VALUES
+    ('AT', 20), ('BE', 21), ('BG', 20), ('CY', 19), ('CZ', 21), ('DE', 19), ('DK', 25),
+    ('EE', 24), ('ES', 21), ('FI', 25.5), ('FR', 20), ('GR', 24), ('HR', 25), ('HU', 27),
+    ('IE', 23), ('IT', 22), ('LT', 21), ('LU', 17), ('LV', 21), ('MT', 18), ('NL', 21),
+    ('PL', 23), ('PT', 23), ('RO', 21), ('SE', 25), ('SI', 22), ('SK', 23);
+
+
+-- Transactional outbox: broker messages written in the same transaction as the change that caused
+-- them and published by the relay. sent_at stays NULL until the broker confirmed the message.
+CREATE TABLE outbox
+(
+    id BIGSERIAL PRIMARY KEY,
+    routing_key VARCHAR(100) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
+
+
+-- Broker messages the consumer gave up on after its retries, kept for inspection and replay
+CREATE TABLE dead_letters
+(
+    id SERIAL PRIMARY KEY,
+    message_id VARCHAR(50) NOT NULL DEFAULT '',
+    routing_key VARCHAR(100) NOT NULL,
+    payload TEXT NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    attempts INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    replayed_at TIMESTAMP
+);
+
 
 --Failed Invoices table
 CREATE TABLE failed_invoices
@@ -72,6 +259,13 @@ CREATE TABLE failed_invoices
     invoice_id VARCHAR(50) NOT NULL,
     invoice_date TIMESTAMP NOT NULL,
     email_retry INT NOT NULL,
+    -- the resend job retries RETRYING invoices once next_attempt_at has passed, backing off
+    -- exponentially; UNDELIVERABLE ones failed permanently or ran out of attempts
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'RETRYING',
     FOREIGN KEY (subscription_id) REFERENCES subscriptions(id)
 
 );
+
+CREATE INDEX failed_invoices_due_idx ON failed_invoices (next_attempt_at) WHERE status = 'RETRYING';
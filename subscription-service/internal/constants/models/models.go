@@ -2,6 +2,8 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"subscription-service/internal/pkg/money"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -14,6 +16,7 @@ type User struct {
 	FirstName string    `json:"first_name,omitempty"`
 	LastName  string    `json:"last_name,omitempty"`
 	Password  string    `json:"-"`
+	Role      string    `json:"role"`
 	Active    int       `json:"active"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -46,38 +49,150 @@ type Address struct {
 	PostalCode string `json:"PostalCode"`
 	City       string `json:"City"`
 	Country    string `json:"Country"`
+	// VatID is the customer's VAT identification number, set for EU business customers
+	VatID string `json:"VatID,omitempty"`
 }
 
 // Plan is the structure which holds one subscription plan from the database.
 type Plan struct {
-	ID                    int     `json:"ID"`
-	Name                  string  `json:"Name"`
-	Duration              int32   `json:"Duration"`
-	DurationUnits         string  `json:"DurationUnits"`
-	BillingFrequency      int32   `json:"BillingFrequency"`
-	BillingFrequencyUnits string  `json:"BillingFrequencyUnits"`
-	Price                 float32 `json:"Price"`
-	Currency              string  `json:"Currency"`
+	ID                    int         `json:"ID"`
+	Name                  string      `json:"Name"`
+	Duration              int32       `json:"Duration"`
+	DurationUnits         string      `json:"DurationUnits"`
+	BillingFrequency      int32       `json:"BillingFrequency"`
+	BillingFrequencyUnits string      `json:"BillingFrequencyUnits"`
+	Price                 money.Money `json:"Price"`
+	// TrialDays is the length of the free trial new subscriptions start with, zero for none
+	TrialDays int `json:"TrialDays"`
 }
 
 // Subscription is the structure which holds one subscription from the database.
 type Subscription struct {
-	ID                    int       `json:"ID"`
-	UserID                int       `json:"UserID"`
-	PlanID                int       `json:"PlanID"`
-	ContractStartDate     time.Time `json:"ContractStartDate"`
-	Duration              int32     `json:"Duration"`
-	DurationUnits         string    `json:"DurationUnits"`
-	BillingFrequency      int32     `json:"BillingFrequency"`
-	BillingFrequencyUnits string    `json:"BillingFrequencyUnits"`
-	Price                 float32   `json:"Price"`
-	Currency              string    `json:"Currency"`
-	ProductCode           string    `json:"ProductCode"`
-	Status                string    `json:"Status"`
-	BilledCycles          int       `json:"BilledCycles"`
-	NextBillingDate       time.Time `json:"NextBillingDate"`
-	CreatedAt             time.Time `json:"CreatedAt"`
-	UpdatedAt             time.Time `json:"UpdatedAt"`
+	ID                    int         `json:"ID"`
+	UserID                int         `json:"UserID"`
+	PlanID                int         `json:"PlanID"`
+	ContractStartDate     time.Time   `json:"ContractStartDate"`
+	Duration              int32       `json:"Duration"`
+	DurationUnits         string      `json:"DurationUnits"`
+	BillingFrequency      int32       `json:"BillingFrequency"`
+	BillingFrequencyUnits string      `json:"BillingFrequencyUnits"`
+	Price                 money.Money `json:"Price"`
+	ProductCode           string      `json:"ProductCode"`
+	Status                string      `json:"Status"`
+	BilledCycles          int         `json:"BilledCycles"`
+	NextBillingDate       time.Time   `json:"NextBillingDate"`
+	CreatedAt             time.Time   `json:"CreatedAt"`
+	UpdatedAt             time.Time   `json:"UpdatedAt"`
+	// CancelAtPeriodEnd cancels the subscription instead of billing it on the next billing date
+	CancelAtPeriodEnd bool       `json:"CancelAtPeriodEnd"`
+	CanceledAt        *time.Time `json:"CanceledAt,omitempty"`
+	// SkippedCycles counts the cycles that were paused and are billed after the contract end instead
+	SkippedCycles int `json:"SkippedCycles"`
+	// PausedCycles is the number of cycles skipped by the current pause, zero when not paused
+	PausedCycles int `json:"PausedCycles"`
+	// TrialEndsAt is the end of the free trial the subscription started with; the contract starts then
+	TrialEndsAt *time.Time `json:"TrialEndsAt,omitempty"`
+}
+
+// Coupon is a discount code. A PERCENT coupon takes Percent off each affected invoice line, a FIXED
+// coupon takes Amount off it. Duration is ONCE, REPEATING for DurationCycles invoices, or FOREVER.
+type Coupon struct {
+	ID             int           `json:"ID"`
+	Code           string        `json:"Code"`
+	Kind           string        `json:"Kind"`
+	Percent        money.Percent `json:"Percent,omitempty"`
+	Amount         *money.Money  `json:"Amount,omitempty"`
+	Duration       string        `json:"Duration"`
+	DurationCycles int           `json:"DurationCycles,omitempty"`
+	// MaxRedemptions limits how many subscriptions may use the coupon, zero means unlimited
+	MaxRedemptions int        `json:"MaxRedemptions"`
+	TimesRedeemed  int        `json:"TimesRedeemed"`
+	ExpiresAt      *time.Time `json:"ExpiresAt,omitempty"`
+	Active         bool       `json:"Active"`
+	CreatedAt      time.Time  `json:"CreatedAt"`
+	UpdatedAt      time.Time  `json:"UpdatedAt"`
+}
+
+// Validate checks that the coupon's discount and duration are consistent
+func (c Coupon) Validate() error {
+	if c.Code == "" {
+		return errors.New("coupon code is required")
+	}
+
+	switch c.Kind {
+	case "PERCENT":
+		if c.Percent <= 0 || c.Percent > 10000 {
+			return errors.New("percent coupons must take off more than 0 and at most 100 percent")
+		}
+	case "FIXED":
+		if c.Amount == nil || c.Amount.Amount <= 0 {
+			return errors.New("fixed coupons need a positive amount")
+		}
+	default:
+		return errors.New("coupon kind must be PERCENT or FIXED")
+	}
+
+	switch c.Duration {
+	case "ONCE", "FOREVER":
+	case "REPEATING":
+		if c.DurationCycles <= 0 {
+			return errors.New("repeating coupons need a number of cycles")
+		}
+	default:
+		return errors.New("coupon duration must be ONCE, REPEATING or FOREVER")
+	}
+
+	if c.MaxRedemptions < 0 {
+		return errors.New("max redemptions cannot be negative")
+	}
+
+	return nil
+}
+
+// Redeemable reports whether the coupon can still be applied to a new subscription
+func (c Coupon) Redeemable(now time.Time) bool {
+	return c.Active &&
+		(c.ExpiresAt == nil || now.Before(*c.ExpiresAt)) &&
+		(c.MaxRedemptions == 0 || c.TimesRedeemed < c.MaxRedemptions)
+}
+
+// CouponRedemption links a coupon to the subscription it was redeemed for. CyclesApplied counts the
+// cycle invoices issued since the redemption.
+type CouponRedemption struct {
+	ID             int       `json:"ID"`
+	CouponID       int       `json:"CouponID"`
+	SubscriptionID int       `json:"SubscriptionID"`
+	RedeemedAt     time.Time `json:"RedeemedAt"`
+	CyclesApplied  int       `json:"CyclesApplied"`
+	Coupon         Coupon    `json:"Coupon"`
+}
+
+// TaxRate is the VAT rate of a country. A rate with a product code overrides the country's
+// standard rate for that product.
+type TaxRate struct {
+	ID          int           `json:"ID"`
+	Country     string        `json:"Country"`
+	ProductCode string        `json:"ProductCode"`
+	Rate        money.Percent `json:"Rate"`
+}
+
+// SubscriptionEvent is one entry in the audit trail of subscription status transitions.
+type SubscriptionEvent struct {
+	ID             int       `json:"ID"`
+	SubscriptionID int       `json:"SubscriptionID"`
+	Action         string    `json:"Action"`
+	FromStatus     string    `json:"FromStatus"`
+	ToStatus       string    `json:"ToStatus"`
+	ActorID        int       `json:"ActorID,omitempty"`
+	Detail         string    `json:"Detail"`
+	CreatedAt      time.Time `json:"CreatedAt"`
+}
+
+// SubscriptionChange is a subscription update written together with an invoice or audit event. From
+// is the state the change was computed from and guards against concurrent updates, To is the new state.
+type SubscriptionChange struct {
+	From Subscription
+	To   Subscription
 }
 
 // FailedInvoice is the structure which holds one failed invoice data.
@@ -87,6 +202,109 @@ type FailedInvoice struct {
 	InvoiceID      string    `json:"InvoiceID"`
 	InvoiceDate    time.Time `json:"InvoiceDate"`
 	EmailRetry     int       `json:"EmailRetry"`
+	NextAttemptAt  time.Time `json:"NextAttemptAt"`
+	LastError      string    `json:"LastError"`
+	Status         string    `json:"Status"`
+}
+
+// OutboxMessage is one broker message waiting in the outbox to be published by the relay.
+type OutboxMessage struct {
+	ID         int64      `json:"ID"`
+	RoutingKey string     `json:"RoutingKey"`
+	Payload    []byte     `json:"Payload"`
+	Attempts   int        `json:"Attempts"`
+	LastError  string     `json:"LastError"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	SentAt     *time.Time `json:"SentAt"`
+}
+
+// DeadLetter is a broker message the consumer gave up on. Reason is the last processing error and
+// ReplayedAt is set once an admin published the message again.
+type DeadLetter struct {
+	ID         int        `json:"ID"`
+	MessageID  string     `json:"MessageID"`
+	RoutingKey string     `json:"RoutingKey"`
+	Payload    string     `json:"Payload"`
+	Reason     string     `json:"Reason"`
+	Attempts   int        `json:"Attempts"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	ReplayedAt *time.Time `json:"ReplayedAt"`
+}
+
+// InvoiceRecord is the structure which holds one invoice from the invoice ledger.
+type InvoiceRecord struct {
+	ID             int               `json:"ID"`
+	InvoiceNumber  string            `json:"InvoiceNumber"`
+	Kind           string            `json:"Kind"`
+	SubscriptionID int               `json:"SubscriptionID"`
+	BillingRunID   int               `json:"BillingRunID,omitempty"`
+	UserID         int               `json:"UserID"`
+	PeriodStart    time.Time         `json:"PeriodStart"`
+	PeriodEnd      time.Time         `json:"PeriodEnd"`
+	InvoiceDate    time.Time         `json:"InvoiceDate"`
+	DueDate        time.Time         `json:"DueDate"`
+	LineItems      []InvoiceLineItem `json:"LineItems"`
+	Subtotal       money.Money       `json:"Subtotal"`
+	TaxTotal       money.Money       `json:"TaxTotal"`
+	Total          money.Money       `json:"Total"`
+	TaxNote        string            `json:"TaxNote,omitempty"`
+	// BillingName and BillingAddress are the customer details as of the invoice date
+	BillingName    string    `json:"BillingName"`
+	BillingAddress Address   `json:"BillingAddress"`
+	PDFLocation    string    `json:"PDFLocation"`
+	PDFChecksum    string    `json:"PDFChecksum"`
+	Status         string    `json:"Status"`
+	CreatedAt      time.Time `json:"CreatedAt"`
+	UpdatedAt      time.Time `json:"UpdatedAt"`
+}
+
+// Billed reports whether the invoice records the customer details it was billed to. Invoices from
+// before these were kept on the invoice do not.
+func (i InvoiceRecord) Billed() bool {
+	return i.BillingAddress.Address != ""
+}
+
+// InvoiceLineItem is the structure which holds one billed line of an InvoiceRecord.
+type InvoiceLineItem struct {
+	ID        int `json:"ID"`
+	InvoiceID int `json:"InvoiceID"`
+	// SubscriptionID is the subscription the line bills, invoices may consolidate several
+	SubscriptionID int           `json:"SubscriptionID,omitempty"`
+	Name           string        `json:"Name"`
+	Description    string        `json:"Description"`
+	UnitCost       money.Money   `json:"UnitCost"`
+	Quantity       int           `json:"Quantity"`
+	Tax            money.Percent `json:"Tax"`
+	TaxAmount      money.Money   `json:"TaxAmount"`
+	Discount       money.Money   `json:"Discount"`
+	// Amount is the net line total, before tax
+	Amount money.Money `json:"Amount"`
+}
+
+// BillingRun is the structure which holds the outcome of one billing run.
+type BillingRun struct {
+	ID         int       `json:"ID"`
+	Job        string    `json:"Job"`
+	Trigger    string    `json:"Trigger"`
+	PeriodFrom time.Time `json:"PeriodFrom"`
+	PeriodTo   time.Time `json:"PeriodTo"`
+	Status     string    `json:"Status"`
+	Billed     int       `json:"Billed"`
+	Skipped    int       `json:"Skipped"`
+	Failed     int       `json:"Failed"`
+	StartedAt  time.Time `json:"StartedAt"`
+	FinishedAt time.Time `json:"FinishedAt"`
+}
+
+// InvoiceNumbering describes how sequential invoice numbers are rendered, e.g. MOV-2026-000123.
+type InvoiceNumbering struct {
+	Prefix string
+	Digits int
+}
+
+// Format renders the sequence number allocated for the given year.
+func (n InvoiceNumbering) Format(year, sequence int) string {
+	return fmt.Sprintf("%s-%d-%0*d", n.Prefix, year, n.Digits, sequence)
 }
 
 type InvoicePayload struct {
@@ -97,11 +315,15 @@ type InvoicePayload struct {
 }
 
 type Invoice struct {
-	Date            string
+	Number string
+	Date   string
+	// IssuedAt is recorded as the PDF's creation date, so that rendering an invoice again yields the same bytes
+	IssuedAt        time.Time
 	PaymentTerm     string
 	CustomerName    string
 	Description     string
 	Notes           string
+	Currency        string
 	CustomerAddress Address
 	Items           []InvoiceItem
 }
@@ -111,6 +333,56 @@ type InvoiceItem struct {
 	Description string
 	UnitCost    string
 	Quantity    string
-	Tax         string
+	TaxAmount   string
 	Discount    string
 }
+
+// PageRequest selects one page of a list. Cursor is the NextCursor of the previous page and Sort
+// names the field to order by, prefixed with "-" for descending order.
+type PageRequest struct {
+	Limit  int
+	Cursor string
+	Sort   string
+}
+
+// Page is one page of a list. NextCursor is empty on the last page and TotalCount counts all
+// items matching the filters.
+type Page[T any] struct {
+	Items      []T    `json:"Items"`
+	NextCursor string `json:"NextCursor,omitempty"`
+	TotalCount int    `json:"TotalCount"`
+}
+
+// SubscriptionFilter restricts a subscription list; zero fields do not filter. The next billing
+// date range includes both days.
+type SubscriptionFilter struct {
+	Status          string
+	PlanID          int
+	Currency        string
+	ProductCode     string
+	NextBillingFrom time.Time
+	NextBillingTo   time.Time
+}
+
+// InvoiceFilter restricts an invoice list; zero fields do not filter. The invoice date range includes
+// both days.
+type InvoiceFilter struct {
+	Status string
+	From   time.Time
+	To     time.Time
+}
+
+// FailedInvoiceFilter restricts the failed invoice list; zero fields do not filter. The date range
+// applies to the day the invoice first failed and includes both days.
+type FailedInvoiceFilter struct {
+	Status         string
+	SubscriptionID int
+	From           time.Time
+	To             time.Time
+}
+
+// PlanFilter restricts a plan list; zero fields do not filter. Name matches part of the plan name.
+type PlanFilter struct {
+	Currency string
+	Name     string
+}
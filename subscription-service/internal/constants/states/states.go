@@ -4,6 +4,47 @@ const (
 	PENDING         = "PENDING-PAYMENT"
 	ACTIVE          = "ACTIVE"
 	INACTIVE        = "INACTIVE"
+	FINISHED        = "FINISHED"
+	PAUSED          = "PAUSED"
+	CANCELED        = "CANCELED"
+	TRIALING        = "TRIALING"
 	TIME_LAYOUT     = "2006-01-02"
-	MAX_EMAIL_RETRY = 5
+	MAX_EMAIL_RETRY = 8
+
+	INVOICE_DRAFT  = "DRAFT"
+	INVOICE_ISSUED = "ISSUED"
+	INVOICE_SENT   = "SENT"
+	INVOICE_PAID   = "PAID"
+	INVOICE_VOID   = "VOID"
+
+	FAILED_INVOICE_RETRYING      = "RETRYING"
+	FAILED_INVOICE_UNDELIVERABLE = "UNDELIVERABLE"
+
+	INVOICE_KIND_CYCLE     = "CYCLE"
+	INVOICE_KIND_PRORATION = "PRORATION"
+
+	BILLING_RUN_RUNNING   = "RUNNING"
+	BILLING_RUN_COMPLETED = "COMPLETED"
+	BILLING_RUN_FAILED    = "FAILED"
+	BILLING_RUN_SCHEDULED = "SCHEDULED"
+	BILLING_RUN_MANUAL    = "MANUAL"
+	BILLING_JOB_BILLING   = "BILLING"
+	BILLING_JOB_RESEND    = "RESEND"
+
+	SUBSCRIPTION_CANCEL               = "CANCEL"
+	SUBSCRIPTION_CANCEL_AT_PERIOD_END = "CANCEL_AT_PERIOD_END"
+	SUBSCRIPTION_PAUSE                = "PAUSE"
+	SUBSCRIPTION_RESUME               = "RESUME"
+	SUBSCRIPTION_BILL                 = "BILL"
+	SUBSCRIPTION_CHANGE_PLAN          = "CHANGE_PLAN"
+	SUBSCRIPTION_TRIAL_END            = "TRIAL_END"
+
+	COUPON_PERCENT   = "PERCENT"
+	COUPON_FIXED     = "FIXED"
+	COUPON_ONCE      = "ONCE"
+	COUPON_REPEATING = "REPEATING"
+	COUPON_FOREVER   = "FOREVER"
+
+	ROLE_CUSTOMER = "customer"
+	ROLE_ADMIN    = "admin"
 )
@@ -13,13 +13,19 @@ func AuthRouting(handler h.AuthHandler) []routers.Route {
 			Method:      http.MethodPost,
 			Path:        "/login",
 			Handle:      handler.LoginHandler,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{},
 		},
 		{
 			Method:      http.MethodPost,
 			Path:        "/signup",
 			Handle:      handler.SignUpHandler,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/token/refresh",
+			Handle:      handler.RefreshTokenHandler,
+			MiddleWares: []func(http.Handler) http.Handler{},
 		},
 	}
 }
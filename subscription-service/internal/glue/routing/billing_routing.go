@@ -0,0 +1,20 @@
+package routing
+
+import (
+	"net/http"
+
+	"subscription-service/internal/constants/states"
+	h "subscription-service/internal/handlers"
+	"subscription-service/platforms/routers"
+)
+
+func BillingRouting(handler h.BillingHandler, mw h.AuthMiddleware) []routers.Route {
+	return []routers.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/billing-runs",
+			Handle:      handler.TriggerBillingRun,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+	}
+}
@@ -0,0 +1,44 @@
+package routing
+
+import (
+	"net/http"
+
+	"subscription-service/internal/constants/states"
+	h "subscription-service/internal/handlers"
+	"subscription-service/platforms/routers"
+)
+
+func CouponRouting(handler *h.CouponHandler, mw h.AuthMiddleware) []routers.Route {
+	return []routers.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "/coupons",
+			Handle:      handler.CreateCoupon,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/coupons",
+			Handle:      handler.GetAllCoupons,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/coupons/{id}",
+			Handle:      handler.GetCouponByID,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPut,
+			Path:        "/coupons/{id}",
+			Handle:      handler.UpdateCoupon,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodDelete,
+			Path:        "/coupons/{id}",
+			Handle:      handler.DeleteCoupon,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+	}
+}
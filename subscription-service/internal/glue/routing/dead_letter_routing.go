@@ -0,0 +1,32 @@
+package routing
+
+import (
+	"net/http"
+
+	"subscription-service/internal/constants/states"
+	h "subscription-service/internal/handlers"
+	"subscription-service/platforms/routers"
+)
+
+func DeadLetterRouting(handler *h.DeadLetterHandler, mw h.AuthMiddleware) []routers.Route {
+	return []routers.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "/admin/dead-letters",
+			Handle:      handler.GetDeadLetters,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/admin/dead-letters/{id}",
+			Handle:      handler.GetDeadLetterByID,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/dead-letters/{id}/replay",
+			Handle:      handler.ReplayDeadLetter,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+	}
+}
@@ -0,0 +1,32 @@
+package routing
+
+import (
+	"net/http"
+
+	"subscription-service/internal/constants/states"
+	h "subscription-service/internal/handlers"
+	"subscription-service/platforms/routers"
+)
+
+func FailedInvoiceRouting(handler *h.FailedInvoiceHandler, mw h.AuthMiddleware) []routers.Route {
+	return []routers.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "/admin/failed-invoices",
+			Handle:      handler.GetFailedInvoices,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/failed-invoices/{id}/retry",
+			Handle:      handler.RetryFailedInvoice,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodDelete,
+			Path:        "/admin/failed-invoices/{id}",
+			Handle:      handler.DeleteFailedInvoice,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+	}
+}
@@ -0,0 +1,18 @@
+package routing
+
+import (
+	"net/http"
+
+	h "subscription-service/internal/handlers"
+	"subscription-service/platforms/routers"
+)
+
+func HealthRouting(handler *h.HealthHandler) []routers.Route {
+	return []routers.Route{
+		{
+			Method: http.MethodGet,
+			Path:   "/health",
+			Handle: handler.Health,
+		},
+	}
+}
@@ -0,0 +1,39 @@
+package routing
+
+import (
+	"net/http"
+
+	"subscription-service/internal/constants/states"
+	h "subscription-service/internal/handlers"
+	"subscription-service/platforms/routers"
+)
+
+func InvoiceRouting(handler *h.InvoiceHandler, mw h.AuthMiddleware) []routers.Route {
+	return []routers.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "/users/{id}/invoices",
+			Handle:      handler.GetUserInvoices,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireOwnerOrAdmin("id")},
+		},
+		{
+			// the owner check needs the invoice and happens in the handler
+			Method:      http.MethodGet,
+			Path:        "/invoices/{number}/pdf",
+			Handle:      handler.DownloadInvoicePDF,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/invoices/{number}/paid",
+			Handle:      handler.MarkInvoicePaid,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/invoices/{number}/void",
+			Handle:      handler.VoidInvoice,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
+		},
+	}
+}
@@ -3,41 +3,42 @@ package routing
 import (
 	"net/http"
 
+	"subscription-service/internal/constants/states"
 	h "subscription-service/internal/handlers"
 	"subscription-service/platforms/routers"
 )
 
-func PlansRouting(handler *h.PlanHandler) []routers.Route {
+func PlansRouting(handler *h.PlanHandler, mw h.AuthMiddleware) []routers.Route {
 	return []routers.Route{
 		{
 			Method:      http.MethodPost,
 			Path:        "/plans",
 			Handle:      handler.CreatePlan,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
 		},
 		{
 			Method:      http.MethodGet,
 			Path:        "/plans",
 			Handle:      handler.GetAllPlans,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{},
 		},
 		{
 			Method:      http.MethodGet,
 			Path:        "/plans/{id}",
 			Handle:      handler.GetPlanByID,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{},
 		},
 		{
 			Method:      http.MethodPut,
 			Path:        "/plans/{id}",
 			Handle:      handler.UpdatePlan,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
 		},
 		{
 			Method:      http.MethodDelete,
 			Path:        "/plans/{id}",
 			Handle:      handler.DeletePlan,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
 		},
 	}
 }
@@ -3,29 +3,72 @@ package routing
 import (
 	"net/http"
 
+	"subscription-service/internal/constants/states"
 	h "subscription-service/internal/handlers"
 	"subscription-service/platforms/routers"
 )
 
-func SubscriptionRouting(handler h.SubscriptionHandler) []routers.Route {
+func SubscriptionRouting(handler h.SubscriptionHandler, mw h.AuthMiddleware) []routers.Route {
 	return []routers.Route{
 		{
 			Method:      http.MethodGet,
 			Path:        "/users/subscriptions",
 			Handle:      handler.GetAllSubsciptionHandler,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
 		},
 		{
 			Method:      http.MethodGet,
 			Path:        "/users/subscriptions/todays",
 			Handle:      handler.GetSubsciptionsToBillTodayHandler,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_ADMIN)},
 		},
 		{
 			Method:      http.MethodGet,
 			Path:        "/users/{id}/subscriptions",
 			Handle:      handler.GetSubsciptionHandler,
-			MiddleWares: []http.HandlerFunc{},
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN), mw.RequireOwnerOrAdmin("id")},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/users/{id}/subscriptions",
+			Handle:      handler.CreateSubscriptionHandler,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN), mw.RequireOwnerOrAdmin("id")},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/subscriptions/{id}/change-plan",
+			Handle:      handler.ChangePlanHandler,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/subscriptions/{id}/cancel",
+			Handle:      handler.CancelSubscriptionHandler,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/subscriptions/{id}/pause",
+			Handle:      handler.PauseSubscriptionHandler,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/subscriptions/{id}/resume",
+			Handle:      handler.ResumeSubscriptionHandler,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/subscriptions/{id}/coupon",
+			Handle:      handler.ApplyCouponHandler,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN)},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/subscriptions/{id}/events",
+			Handle:      handler.GetSubscriptionEventsHandler,
+			MiddleWares: []func(http.Handler) http.Handler{mw.Authenticate, mw.RequireRole(states.ROLE_CUSTOMER, states.ROLE_ADMIN)},
 		},
 	}
 }
@@ -1,25 +1,27 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"subscription-service/internal/constants/models"
 	"subscription-service/internal/constants/states"
-
-	event "subscription-service/internal/message-broker/rabbitmq"
+	"subscription-service/internal/pkg/auth"
+	"subscription-service/internal/pkg/tax"
 	"subscription-service/internal/storage/db"
 	"time"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type AuthHandler struct {
 	AuthPersistence         db.UserPersistence
 	PlanPersistence         db.PlanPersistence
 	SubscriptionPersistence db.SubscriptionPersistence
-	Rabbit                  *amqp.Connection
+	CouponPersistence       db.CouponPersistence
+	UnitOfWork              db.UnitOfWork
+	OutboxPersistence       db.OutboxPersistence
+	Tokens                  auth.TokenManager
 }
 
 // InvoicePayload is the embedded type (in RequestPayload) that describes a request to process invoice
@@ -34,6 +36,30 @@ type Address struct {
 	PostalCode string `json:"postal_code,omitempty"`
 	City       string `json:"city,omitempty"`
 	Country    string `json:"country,omitempty"`
+	VatID      string `json:"vat_id,omitempty"`
+}
+
+// billingAddress returns the address to store for the customer, with the country given by name or code
+// stored as its ISO 3166 alpha-2 code. It returns tax.ErrUnknownCountry if the country is not recognised.
+func (a Address) billingAddress() (models.Address, error) {
+	country, err := tax.CountryCode(a.Country)
+	if err != nil {
+		return models.Address{}, err
+	}
+
+	return models.Address{
+		Address:    a.Address,
+		Address2:   a.Address2,
+		PostalCode: a.PostalCode,
+		City:       a.City,
+		Country:    country,
+		VatID:      a.VatID,
+	}, nil
+}
+
+type LoginResponse struct {
+	User *models.User `json:"user"`
+	auth.TokenPair
 }
 
 type SignupRequestPayload struct {
@@ -44,16 +70,21 @@ type SignupRequestPayload struct {
 	PlanID            int     `json:"PlanID"`
 	ContractStartDate string  `json:"ContractStartDate"`
 	ProductCode       string  `json:"ProductCode"`
+	CouponCode        string  `json:"CouponCode,omitempty"`
 	Address           Address `json:"Address"`
 }
 
 func NewAuthHandler(AuthPersistence db.UserPersistence, PlanPersistence db.PlanPersistence,
-	SubscriptionPersistence db.SubscriptionPersistence, Rabbit *amqp.Connection) AuthHandler {
+	SubscriptionPersistence db.SubscriptionPersistence, CouponPersistence db.CouponPersistence, UnitOfWork db.UnitOfWork,
+	OutboxPersistence db.OutboxPersistence, Tokens auth.TokenManager) AuthHandler {
 	return AuthHandler{
 		AuthPersistence:         AuthPersistence,
 		PlanPersistence:         PlanPersistence,
 		SubscriptionPersistence: SubscriptionPersistence,
-		Rabbit:                  Rabbit,
+		CouponPersistence:       CouponPersistence,
+		UnitOfWork:              UnitOfWork,
+		OutboxPersistence:       OutboxPersistence,
+		Tokens:                  Tokens,
 	}
 }
 
@@ -73,7 +104,8 @@ func (app *AuthHandler) SignUpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if contractStartDate.Day()-time.Now().Day() < 0 {
+	today, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
+	if contractStartDate.Before(today) {
 		errorJSON(w, errors.New("invalid contract start date"), http.StatusBadRequest)
 		return
 	}
@@ -92,85 +124,96 @@ func (app *AuthHandler) SignUpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usr := models.User{
-		Email:     requestPayload.Email,
-		FirstName: requestPayload.FirstName,
-		LastName:  requestPayload.LastName,
-		Password:  requestPayload.Password,
-		Active:    1,
-	}
-
-	userID, err := app.AuthPersistence.AddUser(usr)
+	// validate the billing country, which the VAT on every invoice depends on
+	addr, err := requestPayload.Address.billingAddress()
 	if err != nil {
 		errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
-	usr.ID = userID
 
-	addr := models.Address{
-		UserID:     userID,
-		Address:    requestPayload.Address.Address,
-		Address2:   requestPayload.Address.Address2,
-		PostalCode: requestPayload.Address.PostalCode,
-		City:       requestPayload.Address.City,
-		Country:    requestPayload.Address.Country,
+	// validate the coupon before anything is written
+	var coupon *models.Coupon
+	if requestPayload.CouponCode != "" {
+		coupon, err = redeemableCoupon(app.CouponPersistence, requestPayload.CouponCode, plan.Price.Currency)
+		if err != nil {
+			couponError(w, err)
+			return
+		}
 	}
 
-	addrID, err := app.AuthPersistence.AddBillingAddress(addr)
-	if err != nil {
-		errorJSON(w, err, http.StatusBadRequest)
-		return
-	}
-	addr.ID = addrID
-
-	subs := models.Subscription{
-		UserID:                userID,
-		PlanID:                plan.ID,
-		ContractStartDate:     contractStartDate,
-		Duration:              plan.Duration,
-		DurationUnits:         plan.DurationUnits,
-		BillingFrequency:      plan.BillingFrequency,
-		BillingFrequencyUnits: plan.BillingFrequencyUnits,
-		Price:                 plan.Price,
-		Currency:              plan.Currency,
-		ProductCode:           requestPayload.ProductCode,
-		Status:                states.ACTIVE,
-		NextBillingDate:       contractStartDate,
+	usr := models.User{
+		Email:     requestPayload.Email,
+		FirstName: requestPayload.FirstName,
+		LastName:  requestPayload.LastName,
+		Password:  requestPayload.Password,
+		Role:      states.ROLE_CUSTOMER,
+		Active:    1,
 	}
 
-	subsID, err := app.SubscriptionPersistence.AddSubscription(subs)
-	if err != nil {
-		errorJSON(w, err, http.StatusBadRequest)
+	var subs models.Subscription
+
+	// the user, address, subscription, coupon redemption and first invoice request are written all
+	// together or not at all
+	err = app.UnitOfWork.Do(func(tx *sql.Tx) error {
+		users := app.AuthPersistence.WithTx(tx)
+		subscriptions := app.SubscriptionPersistence.WithTx(tx)
+		coupons := app.CouponPersistence.WithTx(tx)
+		outbox := app.OutboxPersistence.WithTx(tx)
+
+		usr.ID, err = users.AddUser(usr)
+		if err != nil {
+			return err
+		}
+
+		addr.UserID = usr.ID
+		addr.ID, err = users.AddBillingAddress(addr)
+		if err != nil {
+			return err
+		}
+
+		subs = newSubscription(usr.ID, *plan, requestPayload.ProductCode, contractStartDate)
+		subs.ID, err = subscriptions.AddSubscription(subs)
+		if err != nil {
+			return err
+		}
+
+		if coupon != nil {
+			if err := coupons.Redeem(coupon.ID, subs.ID); err != nil {
+				return err
+			}
+		}
+
+		if today.Equal(subs.NextBillingDate) {
+			return enqueue(outbox, "invoice", models.InvoicePayload{
+				User:           usr,
+				BillingAddress: addr,
+				Subscription:   subs,
+				Plan:           *plan,
+			})
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, db.ErrCouponUnavailable), errors.Is(err, db.ErrCouponAlreadyApplied):
+		couponError(w, err)
+		return
+	case err != nil:
+		errorJSON(w, err, http.StatusInternalServerError)
 		return
-	}
-	subs.ID = subsID
-	now, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
-	
-	if now.Equal(contractStartDate) {
-		app.pushToQueue("invoice", models.InvoicePayload{
-			User:           usr,
-			BillingAddress: addr,
-			Subscription:   subs,
-			Plan:           *plan,
-		})
 	}
 
 	payload := jsonResponse{
 		Error:   false,
 		Message: fmt.Sprintf("Signup user %s", requestPayload.Email),
-		Data:    userID,
+		Data:    usr.ID,
 	}
 
 	writeJSON(w, http.StatusAccepted, payload)
 }
 
-// pushToQueue pushes a message into RabbitMQ
-func (app *AuthHandler) pushToQueue(name string, data any) error {
-	emitter, err := event.NewEventEmitter(app.Rabbit)
-	if err != nil {
-		return err
-	}
-
+// enqueue writes a message for RabbitMQ to the outbox; the relay publishes it once the
+// transaction of outbox has committed
+func enqueue(outbox db.OutboxPersistence, name string, data any) error {
 	payload := InvoicePayload{
 		Name: name,
 		Data: data,
@@ -181,11 +224,8 @@ func (app *AuthHandler) pushToQueue(name string, data any) error {
 		return err
 	}
 
-	err = emitter.Push(string(j), "invoice.SEND")
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err = outbox.Add("invoice.SEND", j)
+	return err
 }
 
 func (app *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -213,10 +253,63 @@ func (app *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Active != 1 {
+		errorJSON(w, errors.New("user is not active"), http.StatusForbidden)
+		return
+	}
+
+	tokens, err := app.Tokens.GenerateTokenPair(*user)
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: fmt.Sprintf("Logged in user %s", user.Email),
-		Data:    user,
+		Data: LoginResponse{
+			User:      user,
+			TokenPair: tokens,
+		},
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *AuthHandler) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.Tokens.ParseRefreshToken(requestPayload.RefreshToken)
+	if err != nil {
+		errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	// reload the user so that role changes and deactivations take effect on refresh
+	user, err := app.AuthPersistence.GetOne(claims.UserID)
+	if err != nil || user.Active != 1 {
+		errorJSON(w, auth.ErrInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := app.Tokens.GenerateTokenPair(*user)
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Token refreshed",
+		Data:    tokens,
 	}
 
 	writeJSON(w, http.StatusAccepted, payload)
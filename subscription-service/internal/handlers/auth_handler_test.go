@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"subscription-service/internal/pkg/tax"
+)
+
+func TestSignupBillingAddress(t *testing.T) {
+	tests := []struct {
+		country string
+		want    string
+		wantErr error
+	}{
+		{"DE", "DE", nil},
+		{"germany", "DE", nil},
+		{"United Kingdom of Great Britain and Northern Ireland", "GB", nil},
+		{"South Georgia and the South Sandwich Islands", "GS", nil},
+		{"Congo, Democratic Republic of the", "CD", nil},
+		{"Atlantis", "", tax.ErrUnknownCountry},
+	}
+
+	for _, tt := range tests {
+		payload := Address{Address: "Main St 1", City: "Berlin", Country: tt.country, VatID: "DE123456789"}
+
+		got, err := payload.billingAddress()
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("billingAddress(%q) error = %v, want %v", tt.country, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// the country is stored as its code, which fits the VARCHAR(25) country columns
+		if got.Country != tt.want {
+			t.Errorf("billingAddress(%q) country = %q, want %q", tt.country, got.Country, tt.want)
+		}
+		if got.Address != payload.Address || got.City != payload.City || got.VatID != payload.VatID {
+			t.Errorf("billingAddress(%q) = %+v, want the payload's address", tt.country, got)
+		}
+	}
+}
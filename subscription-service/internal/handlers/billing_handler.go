@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/scheduler"
+	"time"
+)
+
+type BillingHandler struct {
+	Scheduler *scheduler.SchedulerService
+}
+
+func NewBillingHandler(scheduler *scheduler.SchedulerService) BillingHandler {
+	return BillingHandler{
+		Scheduler: scheduler,
+	}
+}
+
+type BillingRunRequestPayload struct {
+	From string `json:"From"`
+	To   string `json:"To"`
+}
+
+// TriggerBillingRun bills every subscription whose next billing date falls in the requested date range
+func (app *BillingHandler) TriggerBillingRun(w http.ResponseWriter, r *http.Request) {
+	var requestPayload BillingRunRequestPayload
+
+	err := readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	from, err := time.Parse(states.TIME_LAYOUT, requestPayload.From)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	to, err := time.Parse(states.TIME_LAYOUT, requestPayload.To)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	today, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
+	if to.Before(from) || to.After(today) {
+		errorJSON(w, errors.New("invalid billing date range"), http.StatusBadRequest)
+		return
+	}
+
+	run, err := app.Scheduler.RunBilling(from, to, states.BILLING_RUN_MANUAL)
+	if errors.Is(err, scheduler.ErrRunInProgress) {
+		errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Billing run for %s - %s %s", requestPayload.From, requestPayload.To, run.Status),
+		Data:    run,
+	}
+
+	writeJSON(w, http.StatusOK, payload)
+}
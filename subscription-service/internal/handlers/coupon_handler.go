@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+	"subscription-service/internal/storage/db"
+)
+
+var errInvalidCoupon = errors.New("invalid coupon code")
+
+type CouponHandler struct {
+	CouponPersistence db.CouponPersistence
+}
+
+func NewCouponHandler(couponPersistence db.CouponPersistence) *CouponHandler {
+	return &CouponHandler{
+		CouponPersistence: couponPersistence,
+	}
+}
+
+type CouponJSONPayload struct {
+	Code           string        `json:"Code"`
+	Kind           string        `json:"Kind"`
+	Percent        money.Percent `json:"Percent"`
+	Amount         *money.Money  `json:"Amount"`
+	Duration       string        `json:"Duration"`
+	DurationCycles int           `json:"DurationCycles"`
+	MaxRedemptions int           `json:"MaxRedemptions"`
+	ExpiresAt      *time.Time    `json:"ExpiresAt"`
+	// Active defaults to true when omitted
+	Active *bool `json:"Active"`
+}
+
+type ApplyCouponPayload struct {
+	CouponCode string `json:"CouponCode"`
+}
+
+func (p CouponJSONPayload) coupon() models.Coupon {
+	coupon := models.Coupon{
+		Code:           p.Code,
+		Kind:           p.Kind,
+		Percent:        p.Percent,
+		Amount:         p.Amount,
+		Duration:       p.Duration,
+		DurationCycles: p.DurationCycles,
+		MaxRedemptions: p.MaxRedemptions,
+		ExpiresAt:      p.ExpiresAt,
+		Active:         p.Active == nil || *p.Active,
+	}
+	if coupon.Kind != states.COUPON_PERCENT {
+		coupon.Percent = 0
+	}
+	if coupon.Kind != states.COUPON_FIXED {
+		coupon.Amount = nil
+	}
+	if coupon.Duration != states.COUPON_REPEATING {
+		coupon.DurationCycles = 0
+	}
+	return coupon
+}
+
+func (h *CouponHandler) GetAllCoupons(w http.ResponseWriter, r *http.Request) {
+	coupons, err := h.CouponPersistence.GetAllCoupons()
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch coupons"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Coupons",
+		Data:    coupons,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (h *CouponHandler) GetCouponByID(w http.ResponseWriter, r *http.Request) {
+	// Parse coupon ID from request params
+	couponID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	coupon, err := h.CouponPersistence.GetCouponByID(couponID)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("coupon not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch coupon"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Coupon",
+		Data:    coupon,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (h *CouponHandler) CreateCoupon(w http.ResponseWriter, r *http.Request) {
+	// Parse coupon from request body
+	var requestPayload CouponJSONPayload
+	err := readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	coupon := requestPayload.coupon()
+	if err := coupon.Validate(); err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	couponID, err := h.CouponPersistence.InsertCoupon(coupon)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Coupon Created",
+		Data:    couponID,
+	}
+
+	writeJSON(w, http.StatusOK, payload)
+}
+
+func (h *CouponHandler) UpdateCoupon(w http.ResponseWriter, r *http.Request) {
+	// Parse coupon ID from request params
+	couponID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Parse coupon from request body
+	var requestPayload CouponJSONPayload
+	err = readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	coupon := requestPayload.coupon()
+	coupon.ID = couponID
+	if err := coupon.Validate(); err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.CouponPersistence.UpdateCoupon(coupon); err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Coupon Updated",
+		Data:    couponID,
+	}
+
+	writeJSON(w, http.StatusOK, payload)
+}
+
+// DeleteCoupon deactivates the coupon; subscriptions that already redeemed it keep their discount
+func (h *CouponHandler) DeleteCoupon(w http.ResponseWriter, r *http.Request) {
+	// Parse coupon ID from request params
+	couponID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.CouponPersistence.DeactivateCoupon(couponID); err != nil {
+		errorJSON(w, errors.New("failed to delete coupon"), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redeemableCoupon looks up the coupon by code and checks that it can be redeemed for a
+// subscription billed in the given currency
+func redeemableCoupon(couponPersistence db.CouponPersistence, code string, currency string) (*models.Coupon, error) {
+	coupon, err := couponPersistence.GetCouponByCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidCoupon
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !coupon.Redeemable(time.Now()) {
+		return nil, db.ErrCouponUnavailable
+	}
+	if coupon.Amount != nil && coupon.Amount.Currency != currency {
+		return nil, money.ErrCurrencyMismatch
+	}
+
+	return coupon, nil
+}
+
+// couponError maps coupon redemption errors onto response status codes
+func couponError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidCoupon), errors.Is(err, money.ErrCurrencyMismatch):
+		errorJSON(w, err, http.StatusBadRequest)
+	case errors.Is(err, db.ErrCouponUnavailable), errors.Is(err, db.ErrCouponAlreadyApplied):
+		errorJSON(w, err, http.StatusConflict)
+	default:
+		errorJSON(w, err, http.StatusInternalServerError)
+	}
+}
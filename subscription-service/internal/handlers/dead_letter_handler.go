@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"subscription-service/internal/storage/db"
+)
+
+type DeadLetterHandler struct {
+	DeadLetterPersistence db.DeadLetterPersistence
+	OutboxPersistence     db.OutboxPersistence
+	UnitOfWork            db.UnitOfWork
+}
+
+func NewDeadLetterHandler(deadLetterPersistence db.DeadLetterPersistence, outboxPersistence db.OutboxPersistence,
+	unitOfWork db.UnitOfWork) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		DeadLetterPersistence: deadLetterPersistence,
+		OutboxPersistence:     outboxPersistence,
+		UnitOfWork:            unitOfWork,
+	}
+}
+
+// GetDeadLetters lists the dead-lettered messages waiting for a replay, or all of them with ?replayed=true
+func (h *DeadLetterHandler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	replayed := r.URL.Query().Get("replayed") == "true"
+
+	letters, err := h.DeadLetterPersistence.GetDeadLetters(replayed)
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch dead letters"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Dead letters",
+		Data:    letters,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (h *DeadLetterHandler) GetDeadLetterByID(w http.ResponseWriter, r *http.Request) {
+	// Parse dead letter ID from request params
+	letterID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	letter, err := h.DeadLetterPersistence.GetDeadLetterByID(letterID)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("dead letter not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch dead letter"), http.StatusBadRequest)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Dead letter",
+		Data:    letter,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+// ReplayDeadLetter publishes a dead-lettered message again with its original routing key. The message
+// goes through the outbox, so it starts over with a fresh retry budget.
+func (h *DeadLetterHandler) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	// Parse dead letter ID from request params
+	letterID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	letter, err := h.DeadLetterPersistence.GetDeadLetterByID(letterID)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("dead letter not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch dead letter"), http.StatusBadRequest)
+		return
+	}
+
+	err = h.UnitOfWork.Do(func(tx *sql.Tx) error {
+		deadLetters := h.DeadLetterPersistence.WithTx(tx)
+		outbox := h.OutboxPersistence.WithTx(tx)
+
+		if err := deadLetters.MarkReplayed(letter.ID); err != nil {
+			return err
+		}
+		_, err := outbox.Add(letter.RoutingKey, []byte(letter.Payload))
+		return err
+	})
+	if errors.Is(err, db.ErrDeadLetterReplayed) {
+		errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to replay dead letter"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Dead letter replayed",
+		Data:    letter.ID,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
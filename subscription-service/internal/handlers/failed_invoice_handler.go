@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/scheduler"
+	"subscription-service/internal/storage/db"
+)
+
+type FailedInvoiceHandler struct {
+	InvoicePersistence db.InvoicePersistence
+	Scheduler          *scheduler.SchedulerService
+}
+
+func NewFailedInvoiceHandler(invoicePersistence db.InvoicePersistence, scheduler *scheduler.SchedulerService) *FailedInvoiceHandler {
+	return &FailedInvoiceHandler{
+		InvoicePersistence: invoicePersistence,
+		Scheduler:          scheduler,
+	}
+}
+
+// GetFailedInvoices lists the invoices whose email could not be sent, filtered by status,
+// subscription_id and the from and to dates of the first failure
+func (h *FailedInvoiceHandler) GetFailedInvoices(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := queryInt(r, "subscription_id")
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	from, err := queryDate(r, "from")
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	to, err := queryDate(r, "to")
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	invoices, err := h.InvoicePersistence.GetAllFailedInvoices(models.FailedInvoiceFilter{
+		Status:         strings.ToUpper(r.URL.Query().Get("status")),
+		SubscriptionID: subscriptionID,
+		From:           from,
+		To:             to,
+	})
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch failed invoices"), http.StatusInternalServerError)
+		return
+	}
+	if invoices == nil {
+		invoices = []models.FailedInvoice{}
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Failed invoices",
+		Data:    invoices,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RetryFailedInvoice resends a failed invoice immediately, also one that was given up as undeliverable.
+// If the email fails again the failed invoice is returned with its next attempt scheduled.
+func (h *FailedInvoiceHandler) RetryFailedInvoice(w http.ResponseWriter, r *http.Request) {
+	// Parse failed invoice ID from request params
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.Scheduler.ResendFailedInvoice(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("failed invoice not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, scheduler.ErrRunInProgress) {
+		errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	// without a failed invoice the error occurred before the email was even attempted
+	if err != nil && invoice.ID == 0 {
+		errorJSON(w, errors.New("failed to fetch failed invoice"), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		payload := jsonResponse{
+			Error:   true,
+			Message: fmt.Sprintf("Resending invoice %s failed: %s", invoice.InvoiceID, err.Error()),
+			Data:    invoice,
+		}
+
+		writeJSON(w, http.StatusBadGateway, payload)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Invoice %s resent", invoice.InvoiceID),
+		Data:    invoice,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+// DeleteFailedInvoice abandons a failed invoice, so that it is not retried anymore. The invoice stays
+// in the ledger.
+func (h *FailedInvoiceHandler) DeleteFailedInvoice(w http.ResponseWriter, r *http.Request) {
+	// Parse failed invoice ID from request params
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.InvoicePersistence.GetFailedInvoiceByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("failed invoice not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch failed invoice"), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.InvoicePersistence.DeleteInvoice(invoice.InvoiceID); err != nil {
+		errorJSON(w, errors.New("failed to delete failed invoice"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Invoice %s abandoned", invoice.InvoiceID),
+		Data:    invoice.ID,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	event "subscription-service/internal/message-broker/rabbitmq"
+)
+
+// healthTimeout bounds the database ping of a health check
+const healthTimeout = 2 * time.Second
+
+type HealthHandler struct {
+	DB     *sql.DB
+	Rabbit *event.ConnectionManager
+}
+
+func NewHealthHandler(db *sql.DB, rabbit *event.ConnectionManager) *HealthHandler {
+	return &HealthHandler{
+		DB:     db,
+		Rabbit: rabbit,
+	}
+}
+
+// HealthStatus reports each dependency as "up" or "down"
+type HealthStatus struct {
+	Database string `json:"Database"`
+	RabbitMQ string `json:"RabbitMQ"`
+}
+
+// Health reports the state of the database and RabbitMQ connections. It answers 503 while either is
+// down, e.g. when RabbitMQ restarted and the connection is being re-established.
+func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	dbUp := h.DB.PingContext(ctx) == nil
+	rabbitUp := h.Rabbit.Connected()
+
+	status := http.StatusOK
+	if !dbUp || !rabbitUp {
+		status = http.StatusServiceUnavailable
+	}
+
+	payload := jsonResponse{
+		Error:   status != http.StatusOK,
+		Message: http.StatusText(status),
+		Data: HealthStatus{
+			Database: upOrDown(dbUp),
+			RabbitMQ: upOrDown(rabbitUp),
+		},
+	}
+
+	writeJSON(w, status, payload)
+}
+
+func upOrDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
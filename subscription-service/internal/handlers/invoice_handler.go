@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/billing"
+	"subscription-service/internal/pkg/invoicestore"
+	"subscription-service/internal/storage/db"
+)
+
+type InvoiceHandler struct {
+	InvoicePersistence db.InvoicePersistence
+	InvoiceService     billing.InvoiceService
+}
+
+func NewInvoiceHandler(invoicePersistence db.InvoicePersistence, invoiceService billing.InvoiceService) *InvoiceHandler {
+	return &InvoiceHandler{
+		InvoicePersistence: invoicePersistence,
+		InvoiceService:     invoiceService,
+	}
+}
+
+// GetUserInvoices lists the user's invoices with their status and totals, newest first unless
+// another sort order is requested
+func (h *InvoiceHandler) GetUserInvoices(w http.ResponseWriter, r *http.Request) {
+	// Parse user ID from request params
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	page, err := pageRequest(r)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if page.Sort == "" {
+		page.Sort = "-invoice_date"
+	}
+
+	from, err := queryDate(r, "from")
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	to, err := queryDate(r, "to")
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	invoices, err := h.InvoicePersistence.ListUserInvoices(userID, models.InvoiceFilter{
+		Status: strings.ToUpper(r.URL.Query().Get("status")),
+		From:   from,
+		To:     to,
+	}, page)
+	if err != nil {
+		listError(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Invoices",
+		Data:    invoices,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
+
+// DownloadInvoicePDF sends the stored PDF of an invoice to its owner or an admin. The checksum
+// serves as ETag, so clients can revalidate a downloaded copy. A PDF missing from the invoice store is
+// rendered again and stored, but the invoice's status is never changed by a download.
+func (h *InvoiceHandler) DownloadInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	invoice, err := h.InvoicePersistence.GetInvoiceByNumber(chi.URLParam(r, "number"))
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("invoice not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to fetch invoice"), http.StatusInternalServerError)
+		return
+	}
+
+	if !canAccessUser(r, invoice.UserID) {
+		errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	pdf, err := h.InvoiceService.InvoicePDF(invoice)
+	if errors.Is(err, invoicestore.ErrNotFound) {
+		errorJSON(w, errors.New("invoice PDF is not available yet"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to load invoice PDF"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", invoice.InvoiceNumber+".pdf"))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", strconv.Quote(invoice.PDFChecksum))
+
+	http.ServeContent(w, r, invoice.InvoiceNumber+".pdf", invoice.UpdatedAt, bytes.NewReader(pdf))
+}
+
+// MarkInvoicePaid records that an issued or sent invoice has been paid
+func (h *InvoiceHandler) MarkInvoicePaid(w http.ResponseWriter, r *http.Request) {
+	h.transitionInvoice(w, r, h.InvoicePersistence.MarkInvoicePaid, "paid")
+}
+
+// VoidInvoice cancels an invoice that has not been paid. A void invoice stays in the ledger, so its
+// number is not reused.
+func (h *InvoiceHandler) VoidInvoice(w http.ResponseWriter, r *http.Request) {
+	h.transitionInvoice(w, r, h.InvoicePersistence.VoidInvoice, "voided")
+}
+
+func (h *InvoiceHandler) transitionInvoice(w http.ResponseWriter, r *http.Request, transition func(string) error, done string) {
+	invoiceNumber := chi.URLParam(r, "number")
+
+	err := transition(invoiceNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("invoice not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, db.ErrInvoiceStatus) {
+		errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		errorJSON(w, errors.New("failed to update invoice"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Invoice %s %s", invoiceNumber, done),
+		Data:    invoiceNumber,
+	}
+
+	writeJSON(w, http.StatusAccepted, payload)
+}
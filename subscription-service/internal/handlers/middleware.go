@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/auth"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AuthMiddleware struct {
+	Tokens auth.TokenManager
+}
+
+func NewAuthMiddleware(tokens auth.TokenManager) AuthMiddleware {
+	return AuthMiddleware{
+		Tokens: tokens,
+	}
+}
+
+// Authenticate validates the bearer access token and stores its claims in the request context
+func (m AuthMiddleware) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found || token == "" {
+			errorJSON(w, errors.New("missing bearer token"), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := m.Tokens.ParseAccessToken(token)
+		if err != nil {
+			errorJSON(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
+	})
+}
+
+// RequireRole rejects authenticated requests whose role is not one of roles.
+// It must be chained after Authenticate.
+func (m AuthMiddleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := auth.ClaimsFromContext(r.Context())
+			if !ok {
+				errorJSON(w, errors.New("unauthenticated"), http.StatusUnauthorized)
+				return
+			}
+
+			for _, role := range roles {
+				if claims.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		})
+	}
+}
+
+// RequireOwnerOrAdmin only lets a customer through when the user ID in the URL
+// parameter param is their own. Admins may access any user.
+func (m AuthMiddleware) RequireOwnerOrAdmin(param string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := strconv.Atoi(chi.URLParam(r, param))
+			if err != nil {
+				errorJSON(w, err, http.StatusBadRequest)
+				return
+			}
+
+			if !canAccessUser(r, userID) {
+				errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// canAccessUser reports whether the authenticated caller may act on behalf of userID
+func canAccessUser(r *http.Request, userID int) bool {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		return false
+	}
+
+	return claims.Role == states.ROLE_ADMIN || claims.UserID == userID
+}
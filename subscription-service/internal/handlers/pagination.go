@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/storage/db"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageRequest reads the limit, cursor and sort query parameters of a list request
+func pageRequest(r *http.Request) (models.PageRequest, error) {
+	query := r.URL.Query()
+	page := models.PageRequest{
+		Limit:  defaultPageSize,
+		Cursor: query.Get("cursor"),
+		Sort:   query.Get("sort"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		page.Limit = n
+	}
+
+	return page, nil
+}
+
+// queryInt reads an optional integer query parameter, zero when absent
+func queryInt(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return n, nil
+}
+
+// queryDate reads an optional date query parameter, the zero time when absent
+func queryDate(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	date, err := time.Parse(states.TIME_LAYOUT, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s, expected %s", name, states.TIME_LAYOUT)
+	}
+	return date, nil
+}
+
+// listError maps list errors onto response status codes
+func listError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrInvalidSort) || errors.Is(err, db.ErrInvalidCursor) {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	errorJSON(w, err, http.StatusInternalServerError)
+}
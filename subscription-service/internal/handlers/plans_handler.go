@@ -2,12 +2,16 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 
 	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/billing"
+	"subscription-service/internal/pkg/money"
 	"subscription-service/internal/storage/db"
 )
 
@@ -22,19 +26,54 @@ func NewPlanHandler(planPersistence db.PlanPersistence) *PlanHandler {
 }
 
 type PlanJSONPayload struct {
-	Name                  string  `json:"Name"`
-	Duration              int32   `json:"Duration"`
-	DurationUnits         string  `json:"DurationUnits"`
-	BillingFrequency      int32   `json:"BillingFrequency"`
-	BillingFrequencyUnits string  `json:"BillingFrequencyUnits"`
-	Price                 float32 `json:"Price"`
-	Currency              string  `json:"Currency"`
+	Name                  string      `json:"Name"`
+	Duration              int32       `json:"Duration"`
+	DurationUnits         string      `json:"DurationUnits"`
+	BillingFrequency      int32       `json:"BillingFrequency"`
+	BillingFrequencyUnits string      `json:"BillingFrequencyUnits"`
+	Price                 money.Money `json:"Price"`
+	TrialDays             int         `json:"TrialDays"`
 }
 
+var errNegativeTrial = errors.New("trial days cannot be negative")
+
+// plan returns the plan described by the payload, rejecting trials, prices and billing schedules the
+// billing engine cannot bill
+func (p PlanJSONPayload) plan() (models.Plan, error) {
+	plan := models.Plan{
+		Name:                  p.Name,
+		Duration:              p.Duration,
+		DurationUnits:         p.DurationUnits,
+		BillingFrequency:      p.BillingFrequency,
+		BillingFrequencyUnits: p.BillingFrequencyUnits,
+		Price:                 p.Price,
+		TrialDays:             p.TrialDays,
+	}
+
+	if plan.TrialDays < 0 {
+		return plan, errNegativeTrial
+	}
+	if err := billing.ValidatePlan(plan); err != nil {
+		return plan, fmt.Errorf("invalid plan: %w", err)
+	}
+	return plan, nil
+}
+
+// GetAllPlans lists the plans page by page, filtered by the currency and name query parameters
 func (h *PlanHandler) GetAllPlans(w http.ResponseWriter, r *http.Request) {
-	plans, err := h.PlanPersistence.GetAllPlans()
+	page, err := pageRequest(r)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	plans, err := h.PlanPersistence.ListPlans(models.PlanFilter{
+		Currency: strings.ToUpper(query.Get("currency")),
+		Name:     query.Get("name"),
+	}, page)
 	if err != nil {
-		errorJSON(w, errors.New("failed to fetch plans"), http.StatusBadRequest)
+		listError(w, err)
 		return
 	}
 
@@ -79,15 +118,13 @@ func (h *PlanHandler) CreatePlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	planID, err := h.PlanPersistence.InsertPlan(models.Plan{
-		Name:                  requestPayload.Name,
-		Duration:              requestPayload.Duration,
-		DurationUnits:         requestPayload.DurationUnits,
-		BillingFrequency:      requestPayload.BillingFrequency,
-		BillingFrequencyUnits: requestPayload.BillingFrequencyUnits,
-		Price:                 requestPayload.Price,
-		Currency:              requestPayload.Currency,
-	})
+	plan, err := requestPayload.plan()
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	planID, err := h.PlanPersistence.InsertPlan(plan)
 	if err != nil {
 		errorJSON(w, err, http.StatusBadRequest)
 		return
@@ -118,15 +155,14 @@ func (h *PlanHandler) UpdatePlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.PlanPersistence.UpdatePlan(models.Plan{
-		ID:                    planID,
-		Name:                  requestPayload.Name,
-		Duration:              requestPayload.Duration,
-		DurationUnits:         requestPayload.DurationUnits,
-		BillingFrequency:      requestPayload.BillingFrequency,
-		BillingFrequencyUnits: requestPayload.BillingFrequencyUnits,
-		Price:                 requestPayload.Price,
-	}); err != nil {
+	plan, err := requestPayload.plan()
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	plan.ID = planID
+
+	if err := h.PlanPersistence.UpdatePlan(plan); err != nil {
 		errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
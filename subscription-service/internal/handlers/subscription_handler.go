@@ -1,46 +1,122 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/auth"
+	"subscription-service/internal/pkg/billing"
+	"subscription-service/internal/pkg/lifecycle"
+	"subscription-service/internal/pkg/money"
+	"subscription-service/internal/pkg/tax"
 	"subscription-service/internal/storage/db"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type SubscriptionHandler struct {
 	SubscriptionPersistence db.SubscriptionPersistence
-	Rabbit                  *amqp.Connection
+	PlanPersistence         db.PlanPersistence
+	UserPersistence         db.UserPersistence
+	CouponPersistence       db.CouponPersistence
+	UnitOfWork              db.UnitOfWork
+	InvoiceService          billing.InvoiceService
+	LifecycleService        lifecycle.Service
 }
 
 func NewSubscriptionHandler(SubscriptionPersistence db.SubscriptionPersistence,
-	Rabbit *amqp.Connection) SubscriptionHandler {
+	PlanPersistence db.PlanPersistence,
+	UserPersistence db.UserPersistence,
+	CouponPersistence db.CouponPersistence,
+	UnitOfWork db.UnitOfWork,
+	InvoiceService billing.InvoiceService,
+	LifecycleService lifecycle.Service) SubscriptionHandler {
 	return SubscriptionHandler{
 		SubscriptionPersistence: SubscriptionPersistence,
-		Rabbit:                  Rabbit,
+		PlanPersistence:         PlanPersistence,
+		UserPersistence:         UserPersistence,
+		CouponPersistence:       CouponPersistence,
+		UnitOfWork:              UnitOfWork,
+		InvoiceService:          InvoiceService,
+		LifecycleService:        LifecycleService,
 	}
 }
 
 type SubscriptionJSONPayload struct {
-	UserID                int       `json:"UserId"`
-	ContractStartDate     time.Time `json:"ContractStartDate"`
-	Duration              int32     `json:"Duration"`
-	DurationUnits         string    `json:"DurationUnits"`
-	BillingFrequency      int32     `json:"BillingFrequency"`
-	BillingFrequencyUnits string    `json:"BillingFrequencyUnits"`
-	Price                 float32   `json:"Price"`
-	Currency              string    `json:"Currency"`
-	ProductCode           string    `json:"ProductCode"`
-	PlanID                string    `json:"PlanID"`
+	UserID                int         `json:"UserId"`
+	ContractStartDate     time.Time   `json:"ContractStartDate"`
+	Duration              int32       `json:"Duration"`
+	DurationUnits         string      `json:"DurationUnits"`
+	BillingFrequency      int32       `json:"BillingFrequency"`
+	BillingFrequencyUnits string      `json:"BillingFrequencyUnits"`
+	Price                 money.Money `json:"Price"`
+	ProductCode           string      `json:"ProductCode"`
+	PlanID                string      `json:"PlanID"`
 }
 
+type CreateSubscriptionPayload struct {
+	PlanID            int    `json:"PlanID"`
+	ProductCode       string `json:"ProductCode"`
+	ContractStartDate string `json:"ContractStartDate"`
+	CouponCode        string `json:"CouponCode,omitempty"`
+}
+
+type CancelPayload struct {
+	AtPeriodEnd bool `json:"AtPeriodEnd"`
+}
+
+type PausePayload struct {
+	Cycles int `json:"Cycles"`
+}
+
+type ChangePlanPayload struct {
+	PlanID int `json:"PlanID"`
+}
+
+// ChangePlanResponse is returned after a plan change. Invoice is the proration invoice and is
+// omitted when nothing had been billed on the old plan yet.
+type ChangePlanResponse struct {
+	Subscription models.Subscription   `json:"Subscription"`
+	Invoice      *models.InvoiceRecord `json:"Invoice,omitempty"`
+}
+
+// GetAllSubsciptionHandler lists the subscriptions page by page. It filters by the status, plan_id,
+// currency, product_code, next_billing_from and next_billing_to query parameters.
 func (app *SubscriptionHandler) GetAllSubsciptionHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := pageRequest(r)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := models.SubscriptionFilter{
+		Status:      query.Get("status"),
+		Currency:    strings.ToUpper(query.Get("currency")),
+		ProductCode: query.Get("product_code"),
+	}
+	if filter.PlanID, err = queryInt(r, "plan_id"); err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if filter.NextBillingFrom, err = queryDate(r, "next_billing_from"); err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if filter.NextBillingTo, err = queryDate(r, "next_billing_to"); err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
 
-	subscriptions, err := app.SubscriptionPersistence.GetAll()
+	subscriptions, err := app.SubscriptionPersistence.List(filter, page)
 	if err != nil {
-		errorJSON(w, err)
+		listError(w, err)
 		return
 	}
 
@@ -53,9 +129,12 @@ func (app *SubscriptionHandler) GetAllSubsciptionHandler(w http.ResponseWriter,
 	writeJSON(w, http.StatusAccepted, resp)
 }
 
+// GetSubsciptionsToBillTodayHandler lists the subscriptions the scheduled billing run invoices today,
+// including periods missed by earlier runs
 func (app *SubscriptionHandler) GetSubsciptionsToBillTodayHandler(w http.ResponseWriter, r *http.Request) {
+	today, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
 
-	subscriptions, err := app.SubscriptionPersistence.GetSubscriptionsToBillToday()
+	subscriptions, err := app.SubscriptionPersistence.GetSubscriptionsDue(time.Time{}, today.AddDate(0, 0, 1))
 	if err != nil {
 		errorJSON(w, err)
 		return
@@ -70,6 +149,7 @@ func (app *SubscriptionHandler) GetSubsciptionsToBillTodayHandler(w http.Respons
 	writeJSON(w, http.StatusAccepted, resp)
 }
 
+// GetSubsciptionHandler lists all subscriptions of the user
 func (app *SubscriptionHandler) GetSubsciptionHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse user ID from request params
 	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
@@ -78,7 +158,7 @@ func (app *SubscriptionHandler) GetSubsciptionHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	subscription, err := app.SubscriptionPersistence.GetByUserID(userID)
+	subscriptions, err := app.SubscriptionPersistence.GetByUserID(userID)
 	if err != nil {
 		errorJSON(w, err)
 		return
@@ -86,9 +166,422 @@ func (app *SubscriptionHandler) GetSubsciptionHandler(w http.ResponseWriter, r *
 
 	resp := jsonResponse{
 		Error:   false,
-		Message: "User Subscription",
+		Message: "User Subscriptions",
+		Data:    subscriptions,
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// CreateSubscriptionHandler adds another subscription for an existing user. The first cycle is
+// billed by the scheduler on the contract start date, on the same invoice as the user's other
+// charges of that day.
+func (app *SubscriptionHandler) CreateSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse user ID from request params
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var requestPayload CreateSubscriptionPayload
+	err = readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	contractStartDate, err := time.Parse(states.TIME_LAYOUT, requestPayload.ContractStartDate)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	today, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
+	if contractStartDate.Before(today) {
+		errorJSON(w, errors.New("invalid contract start date"), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := app.UserPersistence.GetOne(userID); err != nil {
+		errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	// validate the billing country, which the VAT on every invoice depends on
+	addr, err := app.UserPersistence.GetBillingAddressByUserID(userID)
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if _, err := tax.CountryCode(addr.Country); err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	plan, err := app.PlanPersistence.GetPlanByID(requestPayload.PlanID)
+	if err != nil {
+		errorJSON(w, errors.New("invalid plan id"), http.StatusBadRequest)
+		return
+	}
+
+	var coupon *models.Coupon
+	if requestPayload.CouponCode != "" {
+		coupon, err = redeemableCoupon(app.CouponPersistence, requestPayload.CouponCode, plan.Price.Currency)
+		if err != nil {
+			couponError(w, err)
+			return
+		}
+	}
+
+	subscription := newSubscription(userID, *plan, requestPayload.ProductCode, contractStartDate)
+	err = app.UnitOfWork.Do(func(tx *sql.Tx) error {
+		coupons := app.CouponPersistence.WithTx(tx)
+		subscriptions := app.SubscriptionPersistence.WithTx(tx)
+
+		subscription.ID, err = subscriptions.AddSubscription(subscription)
+		if err != nil {
+			return err
+		}
+
+		if coupon != nil {
+			return coupons.Redeem(coupon.ID, subscription.ID)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, db.ErrDuplicateSubscription):
+		errorJSON(w, err, http.StatusConflict)
+		return
+	case errors.Is(err, db.ErrCouponUnavailable), errors.Is(err, db.ErrCouponAlreadyApplied):
+		couponError(w, err)
+		return
+	case err != nil:
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "Subscription Created",
 		Data:    subscription,
 	}
 
 	writeJSON(w, http.StatusAccepted, resp)
 }
+
+// newSubscription returns a new subscription of the user to the plan. Plans with a free trial start
+// in the trial, and the contract, and with it billing, starts once the trial is over.
+func newSubscription(userID int, plan models.Plan, productCode string, contractStartDate time.Time) models.Subscription {
+	subscription := models.Subscription{
+		UserID:                userID,
+		PlanID:                plan.ID,
+		ContractStartDate:     contractStartDate,
+		Duration:              plan.Duration,
+		DurationUnits:         plan.DurationUnits,
+		BillingFrequency:      plan.BillingFrequency,
+		BillingFrequencyUnits: plan.BillingFrequencyUnits,
+		Price:                 plan.Price,
+		ProductCode:           productCode,
+		Status:                states.ACTIVE,
+		NextBillingDate:       contractStartDate,
+	}
+
+	if plan.TrialDays > 0 {
+		trialEndsAt := contractStartDate.AddDate(0, 0, plan.TrialDays)
+		subscription.Status = states.TRIALING
+		subscription.TrialEndsAt = &trialEndsAt
+		subscription.ContractStartDate = trialEndsAt
+		subscription.NextBillingDate = trialEndsAt
+	}
+
+	return subscription
+}
+
+// ChangePlanHandler moves a subscription to another plan. The unused part of the current billing
+// period is credited and charged at the new plan's rate on a proration invoice, and the new plan's
+// billing schedule starts when the current period ends.
+func (app *SubscriptionHandler) ChangePlanHandler(w http.ResponseWriter, r *http.Request) {
+	var requestPayload ChangePlanPayload
+	err := readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	subscription, ok := app.accessibleSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	if subscription.Status != states.ACTIVE && subscription.Status != states.TRIALING {
+		errorJSON(w, errors.New("only active or trialing subscriptions can change plan"), http.StatusConflict)
+		return
+	}
+	if subscription.PlanID == requestPayload.PlanID {
+		errorJSON(w, errors.New("subscription is already on this plan"), http.StatusBadRequest)
+		return
+	}
+
+	newPlan, err := app.PlanPersistence.GetPlanByID(requestPayload.PlanID)
+	if err != nil {
+		errorJSON(w, errors.New("plan not found"), http.StatusBadRequest)
+		return
+	}
+	currentPlan, err := app.PlanPersistence.GetPlanByID(subscription.PlanID)
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	user, err := app.UserPersistence.GetOne(subscription.UserID)
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	addr, err := app.UserPersistence.GetBillingAddressByUserID(subscription.UserID)
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	today, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
+	invoice, changed, err := app.InvoiceService.ChangePlan(models.InvoicePayload{
+		User:           *user,
+		BillingAddress: *addr,
+		Subscription:   *subscription,
+		Plan:           *currentPlan,
+	}, *newPlan, today)
+	switch {
+	case errors.Is(err, money.ErrCurrencyMismatch):
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	case errors.Is(err, db.ErrSubscriptionAlreadyBilled):
+		errorJSON(w, errors.New("subscription changed concurrently, please retry"), http.StatusConflict)
+		return
+	case invoice == nil && err != nil:
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// nothing was billed on the old plan yet, so there is no proration invoice to record the change with
+	if invoice == nil {
+		err := app.SubscriptionPersistence.Transition(models.SubscriptionChange{From: *subscription, To: changed}, models.SubscriptionEvent{
+			SubscriptionID: changed.ID,
+			Action:         states.SUBSCRIPTION_CHANGE_PLAN,
+			FromStatus:     subscription.Status,
+			ToStatus:       changed.Status,
+			ActorID:        actorID(r),
+			Detail:         fmt.Sprintf("plan %d -> %d", subscription.PlanID, changed.PlanID),
+		})
+		if errors.Is(err, db.ErrSubscriptionChanged) {
+			errorJSON(w, errors.New("subscription changed concurrently, please retry"), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "Subscription Plan Changed",
+		Data: ChangePlanResponse{
+			Subscription: changed,
+			Invoice:      invoice,
+		},
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// CancelSubscriptionHandler cancels a subscription immediately, or at the end of the current billing
+// period when AtPeriodEnd is set
+func (app *SubscriptionHandler) CancelSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var requestPayload CancelPayload
+	err := readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	subscription, ok := app.accessibleSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	changed, err := app.LifecycleService.Cancel(*subscription, requestPayload.AtPeriodEnd, actorID(r))
+	if err != nil {
+		lifecycleError(w, err)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "Subscription Canceled",
+		Data:    changed,
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// PauseSubscriptionHandler pauses a subscription for a number of billing cycles, starting at its next billing date
+func (app *SubscriptionHandler) PauseSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var requestPayload PausePayload
+	err := readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	subscription, ok := app.accessibleSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	changed, err := app.LifecycleService.Pause(*subscription, requestPayload.Cycles, actorID(r))
+	if err != nil {
+		lifecycleError(w, err)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "Subscription Paused",
+		Data:    changed,
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// ResumeSubscriptionHandler ends a pause early or withdraws a pending cancellation
+func (app *SubscriptionHandler) ResumeSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := app.accessibleSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	changed, err := app.LifecycleService.Resume(*subscription, actorID(r))
+	if err != nil {
+		lifecycleError(w, err)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "Subscription Resumed",
+		Data:    changed,
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// ApplyCouponHandler redeems a coupon for an existing subscription. The discount applies from the
+// next cycle invoice on.
+func (app *SubscriptionHandler) ApplyCouponHandler(w http.ResponseWriter, r *http.Request) {
+	var requestPayload ApplyCouponPayload
+	err := readJSON(w, r, &requestPayload)
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	subscription, ok := app.accessibleSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	if subscription.Status == states.CANCELED {
+		errorJSON(w, errors.New("subscription is canceled"), http.StatusConflict)
+		return
+	}
+
+	coupon, err := redeemableCoupon(app.CouponPersistence, requestPayload.CouponCode, subscription.Price.Currency)
+	if err != nil {
+		couponError(w, err)
+		return
+	}
+
+	if err := app.CouponPersistence.Redeem(coupon.ID, subscription.ID); err != nil {
+		couponError(w, err)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "Coupon Applied",
+		Data:    coupon,
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// GetSubscriptionEventsHandler returns the audit trail of a subscription's lifecycle transitions
+func (app *SubscriptionHandler) GetSubscriptionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := app.accessibleSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := app.SubscriptionPersistence.GetEvents(subscription.ID)
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "Subscription Events",
+		Data:    events,
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// accessibleSubscription loads the subscription named by the id URL parameter and checks that the
+// caller owns it or is an admin. It writes the error response and returns false otherwise.
+func (app *SubscriptionHandler) accessibleSubscription(w http.ResponseWriter, r *http.Request) (*models.Subscription, bool) {
+	subscriptionID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorJSON(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+
+	subscription, err := app.SubscriptionPersistence.GetOne(subscriptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorJSON(w, errors.New("subscription not found"), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		errorJSON(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if !canAccessUser(r, subscription.UserID) {
+		errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return nil, false
+	}
+
+	return subscription, true
+}
+
+// actorID returns the ID of the authenticated user, recorded in the subscription audit trail
+func actorID(r *http.Request) int {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		return 0
+	}
+	return claims.UserID
+}
+
+// lifecycleError maps lifecycle errors onto response status codes
+func lifecycleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, lifecycle.ErrInvalidTransition), errors.Is(err, db.ErrSubscriptionChanged):
+		errorJSON(w, err, http.StatusConflict)
+	case errors.Is(err, lifecycle.ErrInvalidPause):
+		errorJSON(w, err, http.StatusBadRequest)
+	default:
+		errorJSON(w, err, http.StatusInternalServerError)
+	}
+}
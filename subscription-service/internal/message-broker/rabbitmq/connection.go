@@ -0,0 +1,181 @@
+package event
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrNotConnected is returned while the connection to RabbitMQ is down and being re-established
+var ErrNotConnected = errors.New("not connected to RabbitMQ")
+
+const (
+	// startupAttempts is how often the first connection is tried before the service gives up
+	startupAttempts = 6
+	// maxBackoff caps the wait between two connection attempts
+	maxBackoff = 30 * time.Second
+)
+
+// ConnectionManager keeps a connection to RabbitMQ open. When the connection is closed it reconnects
+// with exponential backoff and re-declares the exchanges and queues. Emitters and consumers ask it for
+// a channel on every use, so they continue on the new connection; consumers wait on Ready to
+// resubscribe.
+type ConnectionManager struct {
+	url    string
+	topics []string
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	ready  chan struct{}
+	closed bool
+}
+
+// NewConnectionManager connects to the broker at url and declares the topology with the invoice
+// queue bound to topics. It fails if the broker is not reachable after startupAttempts.
+func NewConnectionManager(url string, topics []string) (*ConnectionManager, error) {
+	m := &ConnectionManager{
+		url:    url,
+		topics: topics,
+		ready:  make(chan struct{}),
+	}
+
+	var err error
+	backOff := time.Second
+	for attempt := 1; ; attempt++ {
+		if err = m.connect(); err == nil {
+			break
+		}
+		if attempt == startupAttempts {
+			return nil, err
+		}
+
+		log.Println("RabbitMQ not yet ready, backing off...")
+		time.Sleep(backOff)
+		backOff = nextBackoff(backOff)
+	}
+
+	return m, nil
+}
+
+// Channel opens a channel on the current connection
+func (m *ConnectionManager) Channel() (*amqp.Channel, error) {
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+// Ready returns a channel that is closed while the connection is up
+func (m *ConnectionManager) Ready() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ready
+}
+
+// Connected reports whether the connection is currently up
+func (m *ConnectionManager) Connected() bool {
+	select {
+	case <-m.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the connection for good
+func (m *ConnectionManager) Close() error {
+	m.mu.Lock()
+	conn := m.conn
+	m.conn = nil
+	m.closed = true
+	m.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// connect dials the broker, declares the topology and starts watching the new connection
+func (m *ConnectionManager) connect() error {
+	conn, err := amqp.Dial(m.url)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	err = declareTopology(ch, m.topics)
+	ch.Close()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	m.mu.Lock()
+	m.conn = conn
+	close(m.ready)
+	m.mu.Unlock()
+
+	log.Println("Connected to RabbitMQ!")
+	go m.watch(conn, closed)
+
+	return nil
+}
+
+// watch waits for conn to close and reconnects, unless the manager was closed
+func (m *ConnectionManager) watch(conn *amqp.Connection, closed <-chan *amqp.Error) {
+	reason, ok := <-closed
+
+	m.mu.Lock()
+	if m.conn != conn {
+		m.mu.Unlock()
+		return
+	}
+	m.ready = make(chan struct{})
+	m.mu.Unlock()
+
+	if ok {
+		log.Printf("Error: RabbitMQ connection closed %v", reason.Error())
+	}
+
+	backOff := time.Second
+	for {
+		m.mu.Lock()
+		stopped := m.closed
+		m.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		err := m.connect()
+		if err == nil {
+			return
+		}
+
+		log.Printf("Error: reconnecting to RabbitMQ %v", err.Error())
+		time.Sleep(backOff)
+		backOff = nextBackoff(backOff)
+	}
+}
+
+func nextBackoff(backOff time.Duration) time.Duration {
+	backOff *= 2
+	if backOff > maxBackoff {
+		return maxBackoff
+	}
+	return backOff
+}
@@ -1,29 +1,37 @@
 package event
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"subscription-service/internal/constants/models"
-	"subscription-service/internal/constants/states"
-	ig "subscription-service/internal/pkg/invoicegenerator"
-	"subscription-service/internal/pkg/mailer"
+	"subscription-service/internal/pkg/billing"
+	"subscription-service/internal/storage/db"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// errMalformedMessage is returned for messages that can never be processed; they are dead-lettered
+// without retrying
+var errMalformedMessage = errors.New("malformed message")
+
+// errChannelClosed is returned when the channel a consumer reads from was closed
+var errChannelClosed = errors.New("consumer channel closed")
+
 type Consumer struct {
-	conn             *amqp.Connection
-	invoicegenerator ig.InvoiceGenerator
-	mail             mailer.Mail
+	conn                  *ConnectionManager
+	invoiceService        billing.InvoiceService
+	deadLetterPersistence db.DeadLetterPersistence
 }
 
-func NewConsumer(conn *amqp.Connection, invoicegenerator ig.InvoiceGenerator, mail mailer.Mail) (Consumer, error) {
+func NewConsumer(conn *ConnectionManager, invoiceService billing.InvoiceService, deadLetterPersistence db.DeadLetterPersistence) (Consumer, error) {
 	consumer := Consumer{
-		conn:             conn,
-		invoicegenerator: invoicegenerator,
-		mail:             mail,
+		conn:                  conn,
+		invoiceService:        invoiceService,
+		deadLetterPersistence: deadLetterPersistence,
 	}
 
 	err := consumer.setup()
@@ -39,6 +47,7 @@ func (consumer *Consumer) setup() error {
 	if err != nil {
 		return err
 	}
+	defer channel.Close()
 
 	return declareExchange(channel)
 }
@@ -48,179 +57,227 @@ type Payload struct {
 	Data interface{} `json:"data"`
 }
 
-func (consumer *Consumer) Listen(topics []string) error {
+// Listen consumes the durable invoice queue. A message is acknowledged once it has been processed; a
+// failed message is retried after retryDelay and dead-lettered after maxAttempts. When the connection
+// is lost Listen resubscribes as soon as it has been re-established, so it never returns.
+func (consumer *Consumer) Listen() {
+	resubscribe(consumer.conn, "invoice queue", consumer.consume)
+}
+
+// ListenDeadLetters stores the dead-lettered messages for inspection and replay, resubscribing like
+// Listen; it never returns.
+func (consumer *Consumer) ListenDeadLetters() {
+	resubscribe(consumer.conn, "dead-letter queue", consumer.consumeDeadLetters)
+}
+
+// resubscribe runs consume whenever the connection is up, until the end of the process
+func resubscribe(conn *ConnectionManager, queue string, consume func() error) {
+	for {
+		<-conn.Ready()
+
+		err := consume()
+		log.Printf("Error: consuming %s %v", queue, err.Error())
+
+		// give the connection manager time to notice a lost connection
+		time.Sleep(time.Second)
+	}
+}
+
+// consume processes the invoice queue until its channel is closed
+func (consumer *Consumer) consume() error {
 	ch, err := consumer.conn.Channel()
 	if err != nil {
 		return err
 	}
 	defer ch.Close()
 
-	q, err := declareRandomQueue(ch)
+	if err = ch.Qos(prefetch, 0, false); err != nil {
+		return err
+	}
+	// retries and dead letters are only acknowledged once the broker confirmed their copy
+	if err = ch.Confirm(false); err != nil {
+		return err
+	}
+
+	messages, err := ch.Consume(invoiceQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Waiting for message [Exchange, Queue] [%s, %s]", invoiceExchange, invoiceQueue)
+	for d := range messages {
+		go consumer.handle(ch, d)
+	}
+
+	return errChannelClosed
+}
+
+// consumeDeadLetters stores the messages of the dead-letter queue until its channel is closed
+func (consumer *Consumer) consumeDeadLetters() error {
+	ch, err := consumer.conn.Channel()
 	if err != nil {
 		return err
 	}
+	defer ch.Close()
 
-	for _, s := range topics {
-		ch.QueueBind(
-			q.Name,
-			s,
-			"invoice_topic",
-			false,
-			nil,
-		)
+	messages, err := ch.Consume(deadLetterQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
 
+	for d := range messages {
+		_, err := consumer.deadLetterPersistence.AddDeadLetter(models.DeadLetter{
+			MessageID:  d.MessageId,
+			RoutingKey: routingKey(d),
+			Payload:    string(d.Body),
+			Reason:     lastError(d),
+			Attempts:   attempts(d),
+		})
 		if err != nil {
-			return err
+			// leave the message on the queue until the database is back
+			time.Sleep(time.Second)
+			d.Nack(false, true)
+			continue
 		}
+		d.Ack(false)
+	}
+
+	return errChannelClosed
+}
+
+// handle processes one delivery and acknowledges it, or hands it to the retry or dead-letter queue
+func (consumer *Consumer) handle(ch *amqp.Channel, d amqp.Delivery) {
+	err := consumer.process(d)
+	if err == nil {
+		d.Ack(false)
+		return
+	}
+
+	attempt := attempts(d) + 1
+	if errors.Is(err, errMalformedMessage) || attempt >= maxAttempts {
+		log.Printf("Error: dead-lettering message %s after %d attempts %v", d.MessageId, attempt, err.Error())
+		err = forward(ch, d, deadLetterExchange, routingKey(d), attempt, err)
+	} else {
+		log.Printf("Error: retrying message %s in %s %v", d.MessageId, retryDelay, err.Error())
+		err = forward(ch, d, "", retryQueue, attempt, err)
 	}
 
-	messages, err := ch.Consume(q.Name, "", true, false, false, false, nil)
 	if err != nil {
-		return err
+		// the copy was not confirmed, so the message is redelivered instead
+		log.Printf("Error: forwarding message %s %v", d.MessageId, err.Error())
+		d.Nack(false, true)
+		return
 	}
+	d.Ack(false)
+}
 
-	forever := make(chan bool)
-	go func() {
-		for d := range messages {
-			var payload Payload
-			_ = json.Unmarshal(d.Body, &payload)
-			switch payload.Name {
-			case "invoice":
-				go sendInvoice(payload, consumer.invoicegenerator, consumer.mail)
-			default:
-				log.Printf("recieved via rabbit %+v \n", payload)
-			}
+// process handles one message, turning a panic into an error so that the message is retried
+func (consumer *Consumer) process(d amqp.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic processing message: %v", r)
 		}
 	}()
 
-	fmt.Printf("Waiting for message [Exchange, Queue] [invoice_topic, %s]\n", q.Name)
-	<-forever
+	var payload Payload
+	if err := json.Unmarshal(d.Body, &payload); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
 
+	switch payload.Name {
+	case "invoice":
+		return sendInvoice(payload, consumer.invoiceService)
+	default:
+		log.Printf("recieved via rabbit %+v \n", payload)
+	}
 	return nil
 }
 
-// User is the structure which holds one user from the database.
-type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name,omitempty"`
-	LastName  string    `json:"last_name,omitempty"`
-	Active    int       `json:"active"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-}
-
-type Address struct {
-	ID         int    `json:"ID"`
-	UserID     int    `json:"UserID"`
-	Address    string `json:"Address"`
-	Address2   string `json:"Address2"`
-	PostalCode string `json:"PostalCode"`
-	City       string `json:"City"`
-	Country    string `json:"Country"`
-}
-
-// Plan is the structure which holds one subscription plan from the database.
-type Plan struct {
-	ID                    int     `json:"ID"`
-	Name                  string  `json:"Name"`
-	Duration              int32   `json:"Duration"`
-	DurationUnits         string  `json:"DurationUnits"`
-	BillingFrequency      int32   `json:"BillingFrequency"`
-	BillingFrequencyUnits string  `json:"BillingFrequencyUnits"`
-	Price                 float32 `json:"Price"`
-	Currency              string  `json:"Currency"`
-}
-
-// Subscription is the structure which holds one subscription from the database.
-type Subscription struct {
-	ID                    int       `json:"ID"`
-	UserID                int       `json:"UserID"`
-	PlanID                int       `json:"PlanID"`
-	ContractStartDate     time.Time `json:"ContractStartDate"`
-	Duration              int32     `json:"Duration"`
-	DurationUnits         string    `json:"DurationUnits"`
-	BillingFrequency      int32     `json:"BillingFrequency"`
-	BillingFrequencyUnits string    `json:"BillingFrequencyUnits"`
-	Price                 float32   `json:"Price"`
-	Currency              string    `json:"Currency"`
-	ProductCode           string    `json:"ProductCode"`
-	Status                string    `json:"Status"`
-	BilledCycles          int       `json:"BilledCycles"`
-	NextBillingDate       time.Time `json:"NextBillingDate"`
-	CreatedAt             time.Time `json:"CreatedAt"`
-	UpdatedAt             time.Time `json:"UpdatedAt"`
-}
-
-type InvoicePayload struct {
-	User           User         `json:"User"`
-	BillingAddress Address      `json:"BillingAddress"`
-	Subscription   Subscription `json:"Subscription"`
-	Plan           Plan         `json:"Plan"`
-}
-
-func sendInvoice(payload Payload, invoicegenerator ig.InvoiceGenerator, mail mailer.Mail) {
+// forward publishes a copy of the delivery to exchange with the given routing key, recording the
+// attempt and the error that caused it, and waits for the broker to confirm it
+func forward(ch *amqp.Channel, d amqp.Delivery, exchange string, key string, attempt int, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[headerAttempts] = int64(attempt)
+	headers[headerLastError] = cause.Error()
+	headers[headerRoutingKey] = routingKey(d)
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Body:         d.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message was rejected by the broker")
+	}
+	return nil
+}
+
+// attempts returns how often the delivery has been processed before
+func attempts(d amqp.Delivery) int {
+	switch n := d.Headers[headerAttempts].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 0
+}
+
+// routingKey returns the routing key the message was originally published with
+func routingKey(d amqp.Delivery) string {
+	if key, ok := d.Headers[headerRoutingKey].(string); ok {
+		return key
+	}
+	return d.RoutingKey
+}
+
+// lastError returns the error that caused the delivery to be dead-lettered
+func lastError(d amqp.Delivery) string {
+	if reason, ok := d.Headers[headerLastError].(string); ok {
+		return reason
+	}
+	return "rejected"
+}
+
+// sendInvoice issues the invoice requested by payload. It only fails if the invoice could not be
+// written to the ledger; a failed email is retried by the scheduler's resend job.
+func sendInvoice(payload Payload, invoiceService billing.InvoiceService) error {
 	// Parse InvoicePayload
-	var invoicePld InvoicePayload
+	var invoicePld models.InvoicePayload
 	j, err := json.Marshal(payload.Data)
 	if err != nil {
-		log.Println("Error: marshal")
-		log.Println(err)
-		return
+		return fmt.Errorf("%w: %v", errMalformedMessage, err)
 	}
 	err = json.Unmarshal(j, &invoicePld)
 	if err != nil {
-		fmt.Println("Error: unmarshal")
-		fmt.Println(err)
-		return
+		return fmt.Errorf("%w: %v", errMalformedMessage, err)
 	}
 	log.Printf("recieved invoice payload %+v \n", invoicePld)
 
-	// Generate an Invoice
-	invoiceItem := models.InvoiceItem{
-		Name:        fmt.Sprintf("%s %s", invoicePld.Subscription.ProductCode, invoicePld.Plan.Name),
-		Description: "",
-		UnitCost:    fmt.Sprint(invoicePld.Subscription.Price / float32(invoicePld.Subscription.BillingFrequency)),
-		Quantity:    "1",
-		Tax:         "0",
-		Discount:    "0",
-	}
-
-	invoice := models.Invoice{
-		Date:         time.Now().Format(states.TIME_LAYOUT),
-		PaymentTerm:  time.Now().Add(time.Hour * 24 * 7).Format(states.TIME_LAYOUT),
-		CustomerName: fmt.Sprintf("%s %s", invoicePld.User.FirstName, invoicePld.User.LastName),
-		Description:  "Invoice Description",
-		Notes:        "",
-		CustomerAddress: models.Address{
-			Address:    invoicePld.BillingAddress.Address,
-			Address2:   invoicePld.BillingAddress.Address2,
-			PostalCode: invoicePld.BillingAddress.PostalCode,
-			City:       invoicePld.BillingAddress.City,
-			Country:    invoicePld.BillingAddress.Country,
-		},
-		Items: []models.InvoiceItem{invoiceItem},
-	}
-	invoiceID, err := invoicegenerator.Generate(invoice)
-	if err != nil {
-		log.Println("Error: generate invoice")
-		log.Println(err)
-		return
+	invoice, err := invoiceService.Issue(invoicePld, 0)
+	if errors.Is(err, db.ErrSubscriptionAlreadyBilled) {
+		log.Printf("subscription %d already invoiced for this period", invoicePld.Subscription.ID)
+		return nil
 	}
-
-	// Send Email
-	invoicePDF := fmt.Sprintf("../../../temp/%s.pdf", invoiceID)
-	log.Printf("Mail: %+v", mail)
-
-	err = mail.SendSMTPMessage(mailer.Message{
-		To:          invoicePld.User.Email,
-		Subject:     "Invoice For Movido Subscription",
-		Attachments: []string{invoicePDF},
-		Data:        "Invoice",
-		DataMap:     map[string]any{"inv": "Invoice"},
-	})
-	if err != nil {
-		log.Println("Error: sending main")
-		log.Println(err)
+	if invoice == nil {
+		log.Printf("Error: recording invoice %v", err.Error())
+		return err
 	}
+	return nil
 }
@@ -1,13 +1,14 @@
 package event
 
 import (
-	"log"
+	"context"
+	"errors"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type Emitter struct {
-	connection *amqp.Connection
+	connection *ConnectionManager
 }
 
 func (e *Emitter) setup() error {
@@ -20,33 +21,48 @@ func (e *Emitter) setup() error {
 	return declareExchange(channel)
 }
 
-func (e *Emitter) Push(event string, severity string) error {
+// PushConfirmed publishes a persistent message and waits until the broker confirms it. An error
+// means the broker did not take responsibility for the message and it has to be published again.
+func (e *Emitter) PushConfirmed(ctx context.Context, event []byte, severity string, messageID string) error {
 	channel, err := e.connection.Channel()
 	if err != nil {
 		return err
 	}
 	defer channel.Close()
 
-	log.Println("Pushing to channel")
+	if err = channel.Confirm(false); err != nil {
+		return err
+	}
 
-	err = channel.Publish(
-		"invoice_topic",
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(
+		ctx,
+		invoiceExchange,
 		severity,
 		false,
 		false,
 		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(event),
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    messageID,
+			Body:         event,
 		},
 	)
 	if err != nil {
 		return err
 	}
 
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message was rejected by the broker")
+	}
+
 	return nil
 }
 
-func NewEventEmitter(conn *amqp.Connection) (Emitter, error) {
+func NewEventEmitter(conn *ConnectionManager) (Emitter, error) {
 	emitter := Emitter{
 		connection: conn,
 	}
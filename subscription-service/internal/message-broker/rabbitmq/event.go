@@ -1,12 +1,44 @@
 package event
 
 import (
+	"time"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	// invoiceExchange is the topic exchange invoice messages are published to
+	invoiceExchange = "invoice_topic"
+	// deadLetterExchange receives the messages the consumer gave up on
+	deadLetterExchange = "invoice_dlx"
+
+	// invoiceQueue is the durable queue the consumer reads invoice messages from
+	invoiceQueue = "invoice.send"
+	// retryQueue holds failed messages for retryDelay before they return to invoiceQueue
+	retryQueue = "invoice.send.retry"
+	// deadLetterQueue collects dead-lettered messages until they are stored for inspection
+	deadLetterQueue = "invoice.dead"
+)
+
+const (
+	// maxAttempts is how often a message is processed before it is dead-lettered
+	maxAttempts = 5
+	// retryDelay is how long a failed message waits before it is processed again
+	retryDelay = 30 * time.Second
+	// prefetch bounds the number of unacknowledged messages processed at the same time
+	prefetch = 10
+)
+
+// Message headers used to carry the retry state of a message
+const (
+	headerAttempts   = "x-attempts"
+	headerLastError  = "x-last-error"
+	headerRoutingKey = "x-original-routing-key"
+)
+
 func declareExchange(ch *amqp.Channel) error {
 	return ch.ExchangeDeclare(
-		"invoice_topic", // name
+		invoiceExchange, // name
 		"topic",         // type
 		true,            // durable?
 		false,           // auto-deleted?
@@ -16,13 +48,45 @@ func declareExchange(ch *amqp.Channel) error {
 	)
 }
 
-func declareRandomQueue(ch *amqp.Channel) (amqp.Queue, error) {
-	return ch.QueueDeclare(
-		"",    // name?
-		false, // durable?
-		false, // delete when unused?
-		true,  // exclusive?
-		false, // no-wait?
-		nil,   // arguments?
-	)
+// declareTopology declares the exchanges and durable queues of the consumer and binds the invoice
+// queue to topics. Messages rejected from the invoice queue go to the dead-letter exchange, messages
+// in the retry queue expire back into the invoice queue after retryDelay.
+func declareTopology(ch *amqp.Channel, topics []string) error {
+	if err := declareExchange(ch); err != nil {
+		return err
+	}
+
+	err := ch.ExchangeDeclare(deadLetterExchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(invoiceQueue, true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange": deadLetterExchange,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		if err = ch.QueueBind(invoiceQueue, topic, invoiceExchange, false, nil); err != nil {
+			return err
+		}
+	}
+
+	_, err = ch.QueueDeclare(retryQueue, true, false, false, false, amqp.Table{
+		"x-message-ttl":             retryDelay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": invoiceQueue,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(deadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(deadLetterQueue, "#", deadLetterExchange, false, nil)
 }
@@ -0,0 +1,104 @@
+package event
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/storage/db"
+	"time"
+)
+
+// outboxLockKey is the advisory lock key guarding the relay, next to the scheduler's job keys, so
+// that only one replica publishes the outbox and messages leave in the order they were written
+const outboxLockKey int64 = 4711004
+
+const (
+	relayInterval  = time.Second
+	relayBatchSize = 50
+	publishTimeout = 5 * time.Second
+)
+
+// Relay publishes the messages written to the outbox. A message is marked sent only after the
+// broker confirmed it, so every message is delivered at least once; a crash between the confirm and
+// marking it sent publishes it again and consumers have to tolerate duplicates.
+type Relay struct {
+	connection        *ConnectionManager
+	emitter           Emitter
+	outboxPersistence db.OutboxPersistence
+	lockPersistence   db.LockPersistence
+}
+
+func NewRelay(conn *ConnectionManager, outboxPersistence db.OutboxPersistence, lockPersistence db.LockPersistence) (Relay, error) {
+	emitter, err := NewEventEmitter(conn)
+	if err != nil {
+		return Relay{}, err
+	}
+
+	return Relay{
+		connection:        conn,
+		emitter:           emitter,
+		outboxPersistence: outboxPersistence,
+		lockPersistence:   lockPersistence,
+	}, nil
+}
+
+// Run polls the outbox and publishes pending messages, forever
+func (r *Relay) Run() {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.relay()
+	}
+}
+
+// relay publishes pending messages until the outbox is drained. It stops at the first failure and
+// leaves the message pending, to be retried in order on the next tick.
+func (r *Relay) relay() {
+	// while the broker is down the messages simply stay pending
+	if !r.connection.Connected() {
+		return
+	}
+
+	release, acquired, err := r.lockPersistence.TryLock(outboxLockKey)
+	if err != nil {
+		log.Printf("Error: locking outbox %v", err.Error())
+		return
+	}
+	if !acquired {
+		return
+	}
+	defer release()
+
+	for {
+		messages, err := r.outboxPersistence.GetPending(relayBatchSize)
+		if err != nil {
+			return
+		}
+
+		for _, message := range messages {
+			if err := r.publish(message); err != nil {
+				log.Printf("Error: publishing outbox message %d %v", message.ID, err.Error())
+				_ = r.outboxPersistence.MarkFailed(message.ID, err)
+				return
+			}
+		}
+
+		if len(messages) < relayBatchSize {
+			return
+		}
+	}
+}
+
+func (r *Relay) publish(message models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	err := r.emitter.PushConfirmed(ctx, message.Payload, message.RoutingKey, strconv.FormatInt(message.ID, 10))
+	if err != nil {
+		return err
+	}
+
+	return r.outboxPersistence.MarkSent(message.ID)
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"subscription-service/internal/constants/models"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+type contextKey string
+
+const claimsKey contextKey = "auth-claims"
+
+// Claims is the payload carried by both access and refresh tokens.
+type Claims struct {
+	UserID    int    `json:"uid"`
+	Role      string `json:"role"`
+	TokenType string `json:"typ"`
+	jwt.RegisteredClaims
+}
+
+// TokenPair is returned to the client after a successful login or refresh.
+type TokenPair struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type TokenManager struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewTokenManager is the function used to create an instance of the TokenManager.
+func NewTokenManager(secret string, accessTTL, refreshTTL time.Duration) TokenManager {
+	return TokenManager{
+		secret:     []byte(secret),
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+	}
+}
+
+// GenerateTokenPair signs a new access and refresh token for the given user
+func (m TokenManager) GenerateTokenPair(user models.User) (TokenPair, error) {
+	now := time.Now()
+
+	accessToken, err := m.sign(user, accessTokenType, now, m.accessTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshToken, err := m.sign(user, refreshTokenType, now, m.refreshTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    now.Add(m.accessTTL),
+	}, nil
+}
+
+// ParseAccessToken validates an access token and returns its claims
+func (m TokenManager) ParseAccessToken(token string) (*Claims, error) {
+	return m.parse(token, accessTokenType)
+}
+
+// ParseRefreshToken validates a refresh token and returns its claims
+func (m TokenManager) ParseRefreshToken(token string) (*Claims, error) {
+	return m.parse(token, refreshTokenType)
+}
+
+func (m TokenManager) sign(user models.User, tokenType string, now time.Time, ttl time.Duration) (string, error) {
+	claims := Claims{
+		UserID:    user.ID,
+		Role:      user.Role,
+		TokenType: tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+}
+
+func (m TokenManager) parse(token string, tokenType string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return m.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.TokenType != tokenType {
+		return nil, ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+// WithClaims returns a copy of ctx carrying the authenticated claims
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the authenticated claims stored by the auth middleware
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,533 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	ig "subscription-service/internal/pkg/invoicegenerator"
+	"subscription-service/internal/pkg/invoicestore"
+	"subscription-service/internal/pkg/mailer"
+	"subscription-service/internal/pkg/money"
+	"subscription-service/internal/pkg/tax"
+	"subscription-service/internal/storage/db"
+	"time"
+)
+
+const paymentTermDays = 7
+
+// storeTimeout bounds reading or writing one PDF in the invoice store
+const storeTimeout = 30 * time.Second
+
+// A failed invoice is retried resendBaseDelay after the first failure, doubling the delay after
+// every further failure up to resendMaxDelay, so that with states.MAX_EMAIL_RETRY attempts delivery
+// is retried for about a day before the invoice is given up as undeliverable.
+const (
+	resendBaseDelay = 15 * time.Minute
+	resendMaxDelay  = 12 * time.Hour
+)
+
+// InvoiceService records, renders and delivers subscription invoices. It is shared by the
+// scheduler and the RabbitMQ consumer so that every billed period ends up in the invoice ledger.
+type InvoiceService struct {
+	invoicePersistence db.InvoicePersistence
+	couponPersistence  db.CouponPersistence
+	unitOfWork         db.UnitOfWork
+	invoicegenerator   ig.InvoiceGenerator
+	store              invoicestore.InvoiceStore
+	mail               mailer.Mail
+	numbering          models.InvoiceNumbering
+	taxEngine          tax.Engine
+	// adminEmail is notified about undeliverable invoices; notifications are only logged if it is empty
+	adminEmail string
+}
+
+func NewInvoiceService(invoicePersistence db.InvoicePersistence, couponPersistence db.CouponPersistence, unitOfWork db.UnitOfWork,
+	invoicegenerator ig.InvoiceGenerator, store invoicestore.InvoiceStore, mail mailer.Mail, adminEmail string, numbering models.InvoiceNumbering, taxEngine tax.Engine) InvoiceService {
+	return InvoiceService{
+		invoicePersistence: invoicePersistence,
+		couponPersistence:  couponPersistence,
+		unitOfWork:         unitOfWork,
+		invoicegenerator:   invoicegenerator,
+		store:              store,
+		mail:               mail,
+		adminEmail:         adminEmail,
+		numbering:          numbering,
+		taxEngine:          taxEngine,
+	}
+}
+
+// Charge is one subscription billed for its next cycle on a consolidated invoice
+type Charge struct {
+	Subscription models.Subscription
+	Plan         models.Plan
+}
+
+// Issue records a draft invoice for the subscription's next billing cycle, advancing the
+// subscription's billed cycles and next billing date in the same transaction, and delivers it.
+// While a redeemed coupon covers the cycle, its discount is added as a separate line.
+// billingRunID links the invoice to the billing run that created it and may be zero.
+// The returned invoice is non-nil whenever it has been written to the ledger, even if
+// rendering or sending failed afterwards; such invoices are queued for a resend. If the period
+// was already invoiced, Issue returns db.ErrSubscriptionAlreadyBilled without writing anything.
+func (s *InvoiceService) Issue(invoicePld models.InvoicePayload, billingRunID int) (*models.InvoiceRecord, error) {
+	return s.IssueConsolidated(invoicePld.User, invoicePld.BillingAddress, []Charge{
+		{Subscription: invoicePld.Subscription, Plan: invoicePld.Plan},
+	}, billingRunID)
+}
+
+// IssueConsolidated bills the next cycle of each of the user's subscriptions in charges on a single
+// invoice, which otherwise behaves like Issue. The charges must be in the same currency and the
+// subscriptions are advanced together, so if any of them was billed concurrently nothing is written.
+// The invoice is keyed by the first charge's subscription and covers the span of all billed periods.
+func (s *InvoiceService) IssueConsolidated(user models.User, address models.Address, charges []Charge, billingRunID int) (*models.InvoiceRecord, error) {
+	if len(charges) == 0 {
+		return nil, errors.New("no charges to invoice")
+	}
+
+	currency := charges[0].Subscription.Price.Currency
+	now := time.Now()
+
+	invoice := models.InvoiceRecord{
+		Kind:           states.INVOICE_KIND_CYCLE,
+		SubscriptionID: charges[0].Subscription.ID,
+		BillingRunID:   billingRunID,
+		UserID:         user.ID,
+		InvoiceDate:    now,
+		DueDate:        now.AddDate(0, 0, paymentTermDays),
+		Subtotal:       money.Zero(currency),
+		TaxTotal:       money.Zero(currency),
+		Total:          money.Zero(currency),
+		Status:         states.INVOICE_DRAFT,
+	}
+	billTo(&invoice, user, address)
+
+	var changes []models.SubscriptionChange
+	for i, charge := range charges {
+		subscription := charge.Subscription
+		if subscription.Price.Currency != currency {
+			return nil, money.ErrCurrencyMismatch
+		}
+
+		period, advanced, err := Advance(subscription)
+		if err != nil {
+			log.Printf("Error: computing billing period %v", err.Error())
+			return nil, err
+		}
+		if i == 0 || period.Start.Before(invoice.PeriodStart) {
+			invoice.PeriodStart = period.Start
+		}
+		if period.End.After(invoice.PeriodEnd) {
+			invoice.PeriodEnd = period.End
+		}
+
+		unitCost := CycleAmount(subscription, subscription.BilledCycles)
+		items := []models.InvoiceLineItem{
+			{
+				SubscriptionID: subscription.ID,
+				Name:           fmt.Sprintf("%s %s", subscription.ProductCode, charge.Plan.Name),
+				Description:    fmt.Sprintf("%s - %s", period.Start.Format(states.TIME_LAYOUT), period.End.Format(states.TIME_LAYOUT)),
+				UnitCost:       unitCost,
+				Quantity:       1,
+				Amount:         unitCost,
+			},
+		}
+
+		redemption, err := s.couponPersistence.GetRedemption(subscription.ID)
+		if err != nil {
+			log.Printf("Error: fetching coupon redemption %v", err.Error())
+			return nil, err
+		}
+		if discount, ok := Discount(redemption, unitCost); ok {
+			discount.SubscriptionID = subscription.ID
+			items = append(items, discount)
+		}
+
+		if err := s.applyTax(&invoice, items, address, subscription); err != nil {
+			log.Printf("Error: determining tax %v", err.Error())
+			return nil, err
+		}
+
+		changes = append(changes, models.SubscriptionChange{From: subscription, To: advanced})
+	}
+
+	return s.record(invoice, changes, models.InvoicePayload{
+		User:           user,
+		BillingAddress: address,
+		Subscription:   charges[0].Subscription,
+		Plan:           charges[0].Plan,
+	})
+}
+
+// ChangePlan moves the subscription in invoicePld to newPlan as of the given day. When part of an
+// already billed period is left, a proration invoice crediting the unused time on the current plan
+// and charging the new plan for it is recorded together with the plan change and delivered. The
+// returned subscription is the updated one; the invoice is nil when there was nothing to prorate,
+// in which case the caller is responsible for storing the subscription.
+func (s *InvoiceService) ChangePlan(invoicePld models.InvoicePayload, newPlan models.Plan, at time.Time) (*models.InvoiceRecord, models.Subscription, error) {
+	subscription := invoicePld.Subscription
+	proration, err := Prorate(subscription, invoicePld.Plan, newPlan, at)
+	if err != nil {
+		return nil, subscription, err
+	}
+	if len(proration.LineItems) == 0 {
+		return nil, proration.Subscription, nil
+	}
+
+	currency := subscription.Price.Currency
+	now := time.Now()
+	invoice := models.InvoiceRecord{
+		Kind:           states.INVOICE_KIND_PRORATION,
+		SubscriptionID: subscription.ID,
+		UserID:         invoicePld.User.ID,
+		PeriodStart:    proration.Period.Start,
+		PeriodEnd:      proration.Period.End,
+		InvoiceDate:    now,
+		DueDate:        now.AddDate(0, 0, paymentTermDays),
+		Subtotal:       money.Zero(currency),
+		TaxTotal:       money.Zero(currency),
+		Total:          money.Zero(currency),
+		Status:         states.INVOICE_DRAFT,
+	}
+	billTo(&invoice, invoicePld.User, invoicePld.BillingAddress)
+
+	for i := range proration.LineItems {
+		proration.LineItems[i].SubscriptionID = subscription.ID
+	}
+	if err := s.applyTax(&invoice, proration.LineItems, invoicePld.BillingAddress, subscription); err != nil {
+		log.Printf("Error: determining tax %v", err.Error())
+		return nil, subscription, err
+	}
+
+	changes := []models.SubscriptionChange{{From: subscription, To: proration.Subscription}}
+	invoicePld.Plan = newPlan
+	record, err := s.record(invoice, changes, invoicePld)
+	return record, proration.Subscription, err
+}
+
+// record writes the invoice, its line items and the subscription changes with their audit events to
+// the ledger in one unit of work and delivers it. Invoices that cannot be delivered are queued for the
+// failed invoice resend job by DeliveryFailed.
+func (s *InvoiceService) record(invoice models.InvoiceRecord, changes []models.SubscriptionChange, invoicePld models.InvoicePayload) (*models.InvoiceRecord, error) {
+	storedDates(&invoice)
+
+	var id int
+	var number string
+	err := s.unitOfWork.Do(func(tx *sql.Tx) error {
+		invoices := s.invoicePersistence.WithTx(tx)
+
+		var err error
+		id, number, err = invoices.AddInvoice(invoice, s.numbering, changes)
+		return err
+	})
+	if errors.Is(err, db.ErrSubscriptionAlreadyBilled) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Error: recording invoice %v", err.Error())
+		return nil, err
+	}
+	invoice.ID = id
+	invoice.InvoiceNumber = number
+
+	err = s.Deliver(&invoice, invoicePld)
+	if err != nil {
+		log.Printf("Error: sending invoice %v", err.Error())
+		s.DeliveryFailed(models.FailedInvoice{
+			SubscriptionID: invoice.SubscriptionID,
+			InvoiceID:      invoice.InvoiceNumber,
+			InvoiceDate:    time.Now(),
+		}, err)
+	}
+
+	return &invoice, err
+}
+
+// storedDates sets the invoice and due date to the values they read back as from the database. The
+// TIMESTAMP columns keep the wall clock without its time zone, so the dates are stored in UTC, to the
+// second; the PDF rendered on delivery is then identical to one rendered again from the stored invoice.
+func storedDates(invoice *models.InvoiceRecord) {
+	invoice.InvoiceDate = invoice.InvoiceDate.UTC().Truncate(time.Second)
+	invoice.DueDate = invoice.DueDate.UTC().Truncate(time.Second)
+}
+
+// DeliveryFailed records a failed attempt to deliver the invoice, inserting failedInvoice if it has
+// no ID yet, and returns it updated. The next attempt is scheduled with exponential backoff. If the
+// recipient's mailbox was rejected, or this was attempt states.MAX_EMAIL_RETRY, the invoice is marked
+// undeliverable instead and the admin is notified.
+func (s *InvoiceService) DeliveryFailed(failedInvoice models.FailedInvoice, cause error) models.FailedInvoice {
+	failedInvoice.EmailRetry++
+	failedInvoice.LastError = cause.Error()
+	failedInvoice.Status = states.FAILED_INVOICE_RETRYING
+	failedInvoice.NextAttemptAt = time.Now().Add(resendDelay(failedInvoice.EmailRetry))
+	if mailer.IsPermanent(cause) || failedInvoice.EmailRetry >= states.MAX_EMAIL_RETRY {
+		failedInvoice.Status = states.FAILED_INVOICE_UNDELIVERABLE
+	}
+
+	err := s.unitOfWork.Do(func(tx *sql.Tx) error {
+		invoices := s.invoicePersistence.WithTx(tx)
+
+		if failedInvoice.ID != 0 {
+			return invoices.UpdateInvoice(failedInvoice)
+		}
+		id, err := invoices.AddFailedInvoice(failedInvoice)
+		failedInvoice.ID = id
+		return err
+	})
+	if err != nil {
+		log.Printf("Error: recording failed invoice %s %v", failedInvoice.InvoiceID, err.Error())
+	}
+
+	if failedInvoice.Status == states.FAILED_INVOICE_UNDELIVERABLE {
+		s.notifyUndeliverable(failedInvoice)
+	}
+	return failedInvoice
+}
+
+// resendDelay is how long to wait before retrying an invoice that failed attempt times
+func resendDelay(attempt int) time.Duration {
+	delay := resendBaseDelay
+	for i := 1; i < attempt && delay < resendMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > resendMaxDelay {
+		return resendMaxDelay
+	}
+	return delay
+}
+
+// notifyUndeliverable tells the admin that the invoice will not be retried anymore
+func (s *InvoiceService) notifyUndeliverable(failedInvoice models.FailedInvoice) {
+	log.Printf("Error: invoice %s is undeliverable after %d attempts %v", failedInvoice.InvoiceID, failedInvoice.EmailRetry, failedInvoice.LastError)
+	if s.adminEmail == "" {
+		return
+	}
+
+	err := s.mail.SendSMTPMessage(mailer.Message{
+		To:      s.adminEmail,
+		Subject: fmt.Sprintf("Invoice %s is undeliverable", failedInvoice.InvoiceID),
+		Data: fmt.Sprintf("Invoice %s of subscription %d could not be emailed to the customer after %d attempts and will not be retried. The last error was: %s",
+			failedInvoice.InvoiceID, failedInvoice.SubscriptionID, failedInvoice.EmailRetry, failedInvoice.LastError),
+	})
+	if err != nil {
+		log.Printf("Error: notifying admin about undeliverable invoice %v", err.Error())
+	}
+}
+
+// Deliver emails the invoice PDF to the customer, rendering it and putting it into the invoice store
+// first if that has not happened yet, and advances the ledger status to ISSUED and then SENT. Resending a
+// paid or void invoice leaves its status as it is.
+func (s *InvoiceService) Deliver(invoice *models.InvoiceRecord, invoicePld models.InvoicePayload) error {
+	// invoices recorded before billing details were kept on the invoice are billed to the current ones
+	if !invoice.Billed() {
+		billTo(invoice, invoicePld.User, invoicePld.BillingAddress)
+	}
+
+	pdf, err := s.InvoicePDF(invoice)
+	if err != nil {
+		log.Printf("Error: rendering invoice %v", err.Error())
+		return err
+	}
+	if invoice.Status == states.INVOICE_DRAFT {
+		if err := s.invoicePersistence.UpdateInvoiceStatus(invoice.ID, states.INVOICE_ISSUED, "", ""); err != nil {
+			return err
+		}
+		invoice.Status = states.INVOICE_ISSUED
+	}
+
+	err = s.mail.SendSMTPMessage(mailer.Message{
+		To:      invoicePld.User.Email,
+		Subject: fmt.Sprintf("Invoice %s", invoice.InvoiceNumber),
+		Files: []mailer.File{
+			{Name: invoice.InvoiceNumber + ".pdf", MimeType: "application/pdf", Data: pdf},
+		},
+		Data:    "Invoice",
+		DataMap: map[string]any{"inv": "Invoice"},
+	})
+	if err != nil {
+		log.Println("Error: sending main")
+		log.Println(err)
+		return err
+	}
+
+	if invoice.Status == states.INVOICE_ISSUED {
+		if err := s.invoicePersistence.UpdateInvoiceStatus(invoice.ID, states.INVOICE_SENT, "", ""); err != nil {
+			return err
+		}
+		invoice.Status = states.INVOICE_SENT
+	}
+
+	return nil
+}
+
+// GetInvoicePDF returns the PDF of the ledger invoice with the given number like InvoicePDF
+func (s *InvoiceService) GetInvoicePDF(invoiceNumber string) ([]byte, error) {
+	invoice, err := s.invoicePersistence.GetInvoiceByNumber(invoiceNumber)
+	if err != nil {
+		return nil, err
+	}
+	return s.InvoicePDF(invoice)
+}
+
+// InvoicePDF returns the stored PDF of the ledger invoice, verified against the checksum recorded
+// when it was stored. An invoice that has not been rendered yet, or whose stored PDF is missing or
+// damaged, is rendered from its ledger data and stored; rendering is deterministic, so a lost PDF is
+// restored byte for byte under its original key. Only the invoice's PDF key and checksum are updated,
+// its status is left to Deliver, so serving a download does not issue a draft invoice. It returns
+// invoicestore.ErrNotFound if the PDF is lost and the invoice predates the billing details it would be
+// rendered from.
+func (s *InvoiceService) InvoicePDF(invoice *models.InvoiceRecord) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	if invoice.PDFChecksum != "" {
+		pdf, err := invoicestore.Load(ctx, s.store, invoice.PDFLocation, invoice.PDFChecksum)
+		if !errors.Is(err, invoicestore.ErrNotFound) && !errors.Is(err, invoicestore.ErrChecksumMismatch) {
+			return pdf, err
+		}
+		log.Printf("Error: stored invoice %s is unusable, rendering it again %v", invoice.InvoiceNumber, err.Error())
+	}
+	if !invoice.Billed() {
+		return nil, invoicestore.ErrNotFound
+	}
+
+	pdf, err := s.invoicegenerator.Generate(document(invoice))
+	if err != nil {
+		log.Println("Error: generate invoice")
+		log.Println(err)
+		return nil, err
+	}
+
+	key, checksum, err := invoicestore.Save(ctx, s.store, pdf)
+	if err != nil {
+		log.Printf("Error: storing invoice %v", err.Error())
+		return nil, err
+	}
+	if key == invoice.PDFLocation {
+		return pdf, nil
+	}
+	if invoice.PDFChecksum != "" {
+		log.Printf("Error: invoice %s rendered differently than before, storing it as %s", invoice.InvoiceNumber, key)
+	}
+
+	if err := s.invoicePersistence.UpdateInvoicePDF(invoice.ID, key, checksum); err != nil {
+		return nil, err
+	}
+	invoice.PDFLocation = key
+	invoice.PDFChecksum = checksum
+
+	return pdf, nil
+}
+
+// billTo records the customer's name and billing address on the invoice as of its invoice date
+func billTo(invoice *models.InvoiceRecord, user models.User, address models.Address) {
+	// addresses stored before countries were normalized may hold a country name
+	country := address.Country
+	if code, err := tax.CountryCode(country); err == nil {
+		country = code
+	}
+
+	invoice.BillingName = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
+	invoice.BillingAddress = models.Address{
+		Address:    address.Address,
+		Address2:   address.Address2,
+		PostalCode: address.PostalCode,
+		City:       address.City,
+		Country:    country,
+		VatID:      address.VatID,
+	}
+}
+
+// applyTax determines the VAT of the subscription's product for the customer, taxes the line items
+// and adds them to the invoice and to its net, tax and gross totals. The determination's note is added
+// to the invoice's tax notes, so that a consolidated invoice explains the VAT of each of its charges.
+func (s *InvoiceService) applyTax(invoice *models.InvoiceRecord, items []models.InvoiceLineItem, address models.Address, subscription models.Subscription) error {
+	determination, err := s.taxEngine.Determine(address, subscription.ProductCode)
+	if err != nil {
+		return err
+	}
+
+	net, taxTotal, gross, err := tax.Apply(items, determination, subscription.Price.Currency)
+	if err != nil {
+		return err
+	}
+
+	if invoice.Subtotal, err = invoice.Subtotal.Add(net); err != nil {
+		return err
+	}
+	if invoice.TaxTotal, err = invoice.TaxTotal.Add(taxTotal); err != nil {
+		return err
+	}
+	if invoice.Total, err = invoice.Total.Add(gross); err != nil {
+		return err
+	}
+
+	invoice.LineItems = append(invoice.LineItems, items...)
+	invoice.TaxNote = addNote(invoice.TaxNote, determination.Note)
+
+	return nil
+}
+
+// addNote appends note to the newline-separated notes unless it is empty or already among them
+func addNote(notes, note string) string {
+	if note == "" || slices.Contains(strings.Split(notes, "\n"), note) {
+		return notes
+	}
+	if notes == "" {
+		return note
+	}
+	return notes + "\n" + note
+}
+
+// CycleAmount returns the amount billed for the given zero-based billed cycle. The contract price is
+// allocated over the cycles so that the cycle amounts add up to it exactly; the minor units that do
+// not divide evenly are charged in the first cycles.
+func CycleAmount(subscription models.Subscription, cycle int) money.Money {
+	parts := subscription.Price.Allocate(int(subscription.BillingFrequency))
+	if cycle < 0 || cycle >= len(parts) {
+		return money.Zero(subscription.Price.Currency)
+	}
+	return parts[cycle]
+}
+
+// document maps a ledger invoice onto the structure the PDF generator renders
+func document(invoice *models.InvoiceRecord) models.Invoice {
+	var items []models.InvoiceItem
+	for _, item := range invoice.LineItems {
+		items = append(items, models.InvoiceItem{
+			Name:        item.Name,
+			Description: item.Description,
+			UnitCost:    item.UnitCost.String(),
+			Quantity:    fmt.Sprint(item.Quantity),
+			TaxAmount:   item.TaxAmount.String(),
+			Discount:    item.Discount.String(),
+		})
+	}
+
+	return models.Invoice{
+		Number:       invoice.InvoiceNumber,
+		Date:         invoice.InvoiceDate.Format(states.TIME_LAYOUT),
+		IssuedAt:     invoice.InvoiceDate.UTC().Truncate(time.Second),
+		PaymentTerm:  invoice.DueDate.Format(states.TIME_LAYOUT),
+		CustomerName: invoice.BillingName,
+		Currency:     invoice.Total.Currency,
+		Notes:        invoice.TaxNote,
+		Description: fmt.Sprintf("%s %s - %s", describe(invoice.Kind),
+			invoice.PeriodStart.Format(states.TIME_LAYOUT), invoice.PeriodEnd.Format(states.TIME_LAYOUT)),
+		CustomerAddress: invoice.BillingAddress,
+		Items:           items,
+	}
+}
+
+// describe names the period an invoice of the given kind covers
+func describe(kind string) string {
+	if kind == states.INVOICE_KIND_PRORATION {
+		return "Plan change"
+	}
+	return "Billing period"
+}
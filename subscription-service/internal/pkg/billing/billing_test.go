@@ -0,0 +1,61 @@
+package billing
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/invoicegenerator"
+	"subscription-service/internal/pkg/money"
+)
+
+// reloaded returns t as a Postgres TIMESTAMP column reads it back: the wall clock to the microsecond,
+// labeled UTC
+func reloaded(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1000*1000, time.UTC)
+}
+
+func TestInvoiceRendersIdenticallyAfterReload(t *testing.T) {
+	generator := invoicegenerator.NewInvoiceGenerator("Movido", "1.0", models.Address{Address: "Hauptstr. 1", City: "Berlin", Country: "DE"})
+
+	// issued shortly after midnight in Berlin, which is still the previous day in UTC
+	issued := time.Date(2024, time.March, 1, 0, 30, 15, 123456789, time.FixedZone("CET", 3600))
+
+	invoice := models.InvoiceRecord{
+		InvoiceNumber: "INV-2024-000042",
+		Kind:          states.INVOICE_KIND_CYCLE,
+		PeriodStart:   date(2024, time.March, 1),
+		PeriodEnd:     date(2024, time.April, 1),
+		InvoiceDate:   issued,
+		DueDate:       issued.AddDate(0, 0, paymentTermDays),
+		LineItems: []models.InvoiceLineItem{
+			{Name: "Plan", UnitCost: money.New(1000, "EUR"), Quantity: 1, Amount: money.New(1000, "EUR"), TaxAmount: money.New(190, "EUR")},
+		},
+		Total:          money.New(1190, "EUR"),
+		BillingName:    "Ada Lovelace",
+		BillingAddress: models.Address{Address: "Main St 1", City: "Berlin", Country: "DE"},
+	}
+	storedDates(&invoice)
+
+	delivered, err := generator.Generate(document(&invoice))
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	stored := invoice
+	stored.InvoiceDate = reloaded(invoice.InvoiceDate)
+	stored.DueDate = reloaded(invoice.DueDate)
+
+	rerendered, err := generator.Generate(document(&stored))
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !bytes.Equal(delivered, rerendered) {
+		t.Error("the invoice rendered again after a reload differs from the delivered PDF")
+	}
+	if got := document(&stored).Date; got != "2024-02-29" {
+		t.Errorf("invoice date = %s, want the UTC date 2024-02-29", got)
+	}
+}
@@ -0,0 +1,63 @@
+package billing
+
+import (
+	"fmt"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+)
+
+// Discount returns the line item crediting the redeemed coupon against a cycle invoice of the given
+// amount, or false when the coupon does not cover another cycle. A fixed discount never exceeds the
+// amount, and fixed coupons in another currency than the subscription do not apply.
+func Discount(redemption *models.CouponRedemption, amount money.Money) (models.InvoiceLineItem, bool) {
+	if redemption == nil || !covers(redemption.Coupon, redemption.CyclesApplied) {
+		return models.InvoiceLineItem{}, false
+	}
+
+	coupon := redemption.Coupon
+	var discount money.Money
+	var description string
+
+	switch coupon.Kind {
+	case states.COUPON_PERCENT:
+		discount = coupon.Percent.Of(amount)
+		description = fmt.Sprintf("%s%% off", coupon.Percent)
+	case states.COUPON_FIXED:
+		if coupon.Amount == nil || coupon.Amount.Currency != amount.Currency {
+			return models.InvoiceLineItem{}, false
+		}
+		discount = *coupon.Amount
+		if discount.Amount > amount.Amount {
+			discount = amount
+		}
+		description = fmt.Sprintf("%s %s off", coupon.Amount, coupon.Amount.Currency)
+	default:
+		return models.InvoiceLineItem{}, false
+	}
+
+	if discount.IsZero() {
+		return models.InvoiceLineItem{}, false
+	}
+
+	return models.InvoiceLineItem{
+		Name:        fmt.Sprintf("Discount %s", coupon.Code),
+		Description: description,
+		UnitCost:    discount.Neg(),
+		Quantity:    1,
+		Amount:      discount.Neg(),
+	}, true
+}
+
+// covers reports whether the coupon still applies after it has been applied to the given number of cycles
+func covers(coupon models.Coupon, applied int) bool {
+	switch coupon.Duration {
+	case states.COUPON_ONCE:
+		return applied < 1
+	case states.COUPON_REPEATING:
+		return applied < coupon.DurationCycles
+	case states.COUPON_FOREVER:
+		return true
+	}
+	return false
+}
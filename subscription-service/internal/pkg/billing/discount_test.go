@@ -0,0 +1,60 @@
+package billing
+
+import (
+	"testing"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+)
+
+func TestDiscount(t *testing.T) {
+	fixed := func(amount int64, currency string) *money.Money {
+		m := money.New(amount, currency)
+		return &m
+	}
+
+	tests := []struct {
+		name       string
+		coupon     models.Coupon
+		applied    int
+		amount     int64
+		wantOK     bool
+		wantAmount int64
+	}{
+		{"percent once", models.Coupon{Kind: states.COUPON_PERCENT, Percent: 2000, Duration: states.COUPON_ONCE}, 0, 1000, true, -200},
+		{"percent rounds to the cent", models.Coupon{Kind: states.COUPON_PERCENT, Percent: 1250, Duration: states.COUPON_FOREVER}, 7, 999, true, -125},
+		{"once already applied", models.Coupon{Kind: states.COUPON_PERCENT, Percent: 2000, Duration: states.COUPON_ONCE}, 1, 1000, false, 0},
+		{"repeating within its cycles", models.Coupon{Kind: states.COUPON_FIXED, Amount: fixed(300, "EUR"), Duration: states.COUPON_REPEATING, DurationCycles: 3}, 2, 1000, true, -300},
+		{"repeating used up", models.Coupon{Kind: states.COUPON_FIXED, Amount: fixed(300, "EUR"), Duration: states.COUPON_REPEATING, DurationCycles: 3}, 3, 1000, false, 0},
+		{"fixed capped at the amount", models.Coupon{Kind: states.COUPON_FIXED, Amount: fixed(1500, "EUR"), Duration: states.COUPON_FOREVER}, 0, 1000, true, -1000},
+		{"fixed in another currency", models.Coupon{Kind: states.COUPON_FIXED, Amount: fixed(300, "USD"), Duration: states.COUPON_FOREVER}, 0, 1000, false, 0},
+		{"zero discount", models.Coupon{Kind: states.COUPON_PERCENT, Percent: 1000, Duration: states.COUPON_FOREVER}, 0, 0, false, 0},
+		{"unknown kind", models.Coupon{Kind: "FREE", Duration: states.COUPON_FOREVER}, 0, 1000, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.coupon.Code = "SAVE"
+			redemption := &models.CouponRedemption{Coupon: tt.coupon, CyclesApplied: tt.applied}
+
+			item, ok := Discount(redemption, money.New(tt.amount, "EUR"))
+			if ok != tt.wantOK {
+				t.Fatalf("Discount ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if item.Amount.Amount != tt.wantAmount || item.UnitCost != item.Amount || item.Quantity != 1 {
+				t.Errorf("Discount = %+v, want a single line of %d", item, tt.wantAmount)
+			}
+			if item.Name != "Discount SAVE" {
+				t.Errorf("Discount name = %q, want %q", item.Name, "Discount SAVE")
+			}
+		})
+	}
+
+	if _, ok := Discount(nil, money.New(1000, "EUR")); ok {
+		t.Error("Discount without a redemption applied")
+	}
+}
@@ -0,0 +1,213 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+	"time"
+)
+
+// Period is the half-open time range [Start, End) covered by one billing cycle.
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// normalizeUnit maps the unit spellings accepted by the API (DAY, days, MONTHS, ...) onto
+// day, week, month or year.
+func normalizeUnit(units string) (string, error) {
+	switch strings.TrimSuffix(strings.ToLower(strings.TrimSpace(units)), "s") {
+	case "day":
+		return "day", nil
+	case "week":
+		return "week", nil
+	case "month":
+		return "month", nil
+	case "year":
+		return "year", nil
+	default:
+		return "", fmt.Errorf("unsupported billing unit %q", units)
+	}
+}
+
+// addUnits moves t forward by n units. Month and year steps keep the day of month of t and
+// clamp it to the last day of shorter months, so Jan 31 + 1 month is Feb 28 (or 29).
+func addUnits(t time.Time, unit string, n int) time.Time {
+	switch unit {
+	case "day":
+		return t.AddDate(0, 0, n)
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "year":
+		return addMonths(t, 12*n)
+	default:
+		return addMonths(t, n)
+	}
+}
+
+func addMonths(t time.Time, n int) time.Time {
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+
+	firstOfTarget := time.Date(year, month+time.Month(n), 1, hour, min, sec, t.Nanosecond(), t.Location())
+	lastDay := firstOfTarget.AddDate(0, 1, -1).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+
+	return time.Date(firstOfTarget.Year(), firstOfTarget.Month(), day, hour, min, sec, t.Nanosecond(), t.Location())
+}
+
+// monthBased reports whether the unit is counted in calendar months
+func monthBased(unit string) bool {
+	return unit == "month" || unit == "year"
+}
+
+// splitUnit returns the unit in which the contract is split into billing cycles and the contract
+// duration in that unit. A duration that converts exactly into the billing unit, e.g. a 1 year
+// contract billed in months lasting 12 units, is split in the billing unit. A duration in months
+// billed in years is split in months, and any other combination, such as a yearly contract billed
+// weekly or a monthly contract billed daily, in the calendar days from start to the contract end.
+func splitUnit(start time.Time, duration int32, durationUnit, billingUnit string) (string, int) {
+	switch {
+	case durationUnit == billingUnit:
+		return billingUnit, int(duration)
+	case durationUnit == "year" && billingUnit == "month":
+		return "month", int(duration) * 12
+	case durationUnit == "week" && billingUnit == "day":
+		return "day", int(duration) * 7
+	case monthBased(durationUnit) && monthBased(billingUnit):
+		return "month", int(duration)
+	default:
+		return "day", calendarDays(start, addUnits(start, durationUnit, int(duration)))
+	}
+}
+
+// planReference is the contract start ValidatePlan measures plans from; it starts a 31-day month in a
+// 365-day year, so a month-long contract is not shorter than a 30-day one
+var planReference = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ValidatePlan checks that the plan can be billed: its price must be a positive amount in an ISO 4217
+// currency, and its contract must split into billing cycles. The duration and billing frequency must be
+// positive, both units one of day, week, month or year in any spelling normalizeUnit accepts, no cycle
+// may be shorter than a day, and a single billing unit may not be longer than the whole contract.
+func ValidatePlan(plan models.Plan) error {
+	if !money.ValidCurrency(plan.Price.Currency) {
+		return fmt.Errorf("invalid currency %q", plan.Price.Currency)
+	}
+	if plan.Price.Amount <= 0 {
+		return errors.New("price must be positive")
+	}
+	if plan.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if plan.BillingFrequency <= 0 {
+		return errors.New("billing frequency must be positive")
+	}
+
+	durationUnit, err := normalizeUnit(plan.DurationUnits)
+	if err != nil {
+		return err
+	}
+	billingUnit, err := normalizeUnit(plan.BillingFrequencyUnits)
+	if err != nil {
+		return err
+	}
+
+	contractEnd := addUnits(planReference, durationUnit, int(plan.Duration))
+	if addUnits(planReference, billingUnit, 1).After(contractEnd) {
+		return fmt.Errorf("a %s billing unit is longer than the %d %s contract", billingUnit, plan.Duration, durationUnit)
+	}
+	if _, total := splitUnit(planReference, plan.Duration, durationUnit, billingUnit); int(plan.BillingFrequency) > total {
+		return fmt.Errorf("%d billing cycles do not fit into the %d %s contract", plan.BillingFrequency, plan.Duration, durationUnit)
+	}
+
+	return nil
+}
+
+// calendarDays counts the days from the date of start to the date of end, unaffected by DST changes
+func calendarDays(start, end time.Time) int {
+	from := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	to := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+	return int(to.Sub(from).Hours() / 24)
+}
+
+// cycleBoundary returns the date on which the given zero-based cycle of the subscription starts.
+// The contract is split into BillingFrequency cycles measured in the unit chosen by splitUnit, and
+// every boundary is computed from the contract start so month-end clamping never accumulates drift.
+// The boundary after the last cycle is the contract end date.
+func cycleBoundary(subscription models.Subscription, cycle int) (time.Time, error) {
+	if subscription.BillingFrequency <= 0 {
+		return time.Time{}, fmt.Errorf("subscription %d has no billing cycles", subscription.ID)
+	}
+
+	billingUnit, err := normalizeUnit(subscription.BillingFrequencyUnits)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	durationUnit, err := normalizeUnit(subscription.DurationUnits)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	unit, total := splitUnit(subscription.ContractStartDate, subscription.Duration, durationUnit, billingUnit)
+
+	offset := cycle * total / int(subscription.BillingFrequency)
+	return addUnits(subscription.ContractStartDate, unit, offset), nil
+}
+
+// CyclePeriod returns the period covered by the given zero-based billing cycle.
+func CyclePeriod(subscription models.Subscription, cycle int) (Period, error) {
+	start, err := cycleBoundary(subscription, cycle)
+	if err != nil {
+		return Period{}, err
+	}
+
+	end, err := cycleBoundary(subscription, cycle+1)
+	if err != nil {
+		return Period{}, err
+	}
+
+	return Period{Start: start, End: end}, nil
+}
+
+// CycleStart returns the date on which the given zero-based billing cycle starts. Cycles past the
+// contract's billing frequency continue the same schedule, which is where paused cycles end up.
+func CycleStart(subscription models.Subscription, cycle int) (time.Time, error) {
+	return cycleBoundary(subscription, cycle)
+}
+
+// ContractEnd returns the date on which the subscription's contract ends, extended by any
+// cycles skipped while paused.
+func ContractEnd(subscription models.Subscription) (time.Time, error) {
+	return cycleBoundary(subscription, int(subscription.BillingFrequency)+subscription.SkippedCycles)
+}
+
+// CurrentCycle returns the zero-based schedule position of the subscription's next cycle to bill.
+// Paused cycles keep their place in the schedule, so it runs ahead of BilledCycles by SkippedCycles.
+func CurrentCycle(subscription models.Subscription) int {
+	return subscription.BilledCycles + subscription.SkippedCycles
+}
+
+// Advance returns the period billed by the subscription's next invoice together with the
+// subscription state after that invoice: one more billed cycle, the next billing date moved to
+// the end of the period and the status set to FINISHED once the last cycle has been billed.
+func Advance(subscription models.Subscription) (Period, models.Subscription, error) {
+	period, err := CyclePeriod(subscription, CurrentCycle(subscription))
+	if err != nil {
+		return Period{}, subscription, err
+	}
+
+	next := subscription
+	next.BilledCycles++
+	next.NextBillingDate = period.End
+	if next.BilledCycles >= int(next.BillingFrequency) {
+		next.Status = states.FINISHED
+	}
+
+	return period, next, nil
+}
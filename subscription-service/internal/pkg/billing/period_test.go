@@ -0,0 +1,215 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+)
+
+func TestCyclePeriod(t *testing.T) {
+	monthly := subscribed(yearlyPlan(1, 12000), date(2024, time.January, 31), 0, 0)
+	paused := subscribed(yearlyPlan(1, 12000), date(2024, time.January, 1), 4, 2)
+
+	tests := []struct {
+		name  string
+		cycle int
+		want  Period
+	}{
+		{"first cycle clamps to leap day", 0, Period{Start: date(2024, time.January, 31), End: date(2024, time.February, 29)}},
+		{"clamping does not drift", 1, Period{Start: date(2024, time.February, 29), End: date(2024, time.March, 31)}},
+		{"thirty-day month", 2, Period{Start: date(2024, time.March, 31), End: date(2024, time.April, 30)}},
+		{"final cycle ends at the contract end", 11, Period{Start: date(2024, time.December, 31), End: date(2025, time.January, 31)}},
+		{"skipped cycle continues the schedule", 12, Period{Start: date(2025, time.January, 31), End: date(2025, time.February, 28)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CyclePeriod(monthly, tt.cycle)
+			if err != nil {
+				t.Fatalf("CyclePeriod: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("CyclePeriod(%d) = %v, want %v", tt.cycle, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("current period after a pause", func(t *testing.T) {
+		got, err := currentPeriod(paused)
+		if err != nil {
+			t.Fatalf("currentPeriod: %v", err)
+		}
+		if want := (Period{Start: date(2024, time.June, 1), End: date(2024, time.July, 1)}); got != want {
+			t.Errorf("currentPeriod = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestContractEnd(t *testing.T) {
+	tests := []struct {
+		name    string
+		skipped int
+		want    time.Time
+	}{
+		{"full contract", 0, date(2025, time.January, 1)},
+		{"extended by skipped cycles", 2, date(2025, time.March, 1)},
+	}
+
+	for _, tt := range tests {
+		got, err := ContractEnd(subscribed(yearlyPlan(1, 12000), date(2024, time.January, 1), 0, tt.skipped))
+		if err != nil {
+			t.Fatalf("%s: ContractEnd: %v", tt.name, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: ContractEnd = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePlan(t *testing.T) {
+	eur := money.New(12000, "EUR")
+
+	tests := []struct {
+		name             string
+		duration         int32
+		durationUnits    string
+		billingFrequency int32
+		billingUnits     string
+		price            money.Money
+		wantErr          bool
+	}{
+		{"monthly for a year", 1, "YEAR", 12, "months", eur, false},
+		{"yearly contract billed weekly", 1, "year", 52, "week", eur, false},
+		{"week billed daily", 1, "weeks", 7, "DAY", eur, false},
+		{"zero duration", 0, "month", 1, "month", eur, true},
+		{"negative duration", -12, "month", 12, "month", eur, true},
+		{"zero billing frequency", 12, "month", 0, "month", eur, true},
+		{"unknown duration unit", 12, "fortnight", 12, "month", eur, true},
+		{"unknown billing unit", 12, "month", 12, "quarter", eur, true},
+		{"billing unit longer than the contract", 1, "month", 1, "year", eur, true},
+		{"more cycles than days", 1, "week", 8, "day", eur, true},
+		{"more cycles than months", 1, "year", 24, "month", eur, true},
+		{"zero price", 12, "month", 12, "month", money.Zero("EUR"), true},
+		{"negative price", 12, "month", 12, "month", money.New(-12000, "EUR"), true},
+		{"missing price", 12, "month", 12, "month", money.Money{}, true},
+		{"blank currency", 12, "month", 12, "month", money.Money{Amount: 12000}, true},
+		{"malformed currency", 12, "month", 12, "month", money.New(12000, "EURO"), true},
+	}
+
+	for _, tt := range tests {
+		err := ValidatePlan(models.Plan{
+			Duration:              tt.duration,
+			DurationUnits:         tt.durationUnits,
+			BillingFrequency:      tt.billingFrequency,
+			BillingFrequencyUnits: tt.billingUnits,
+			Price:                 tt.price,
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidatePlan error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCycleBoundary(t *testing.T) {
+	schedule := func(start time.Time, duration int32, durationUnits string, frequency int32, billingUnits string) models.Subscription {
+		return models.Subscription{
+			ContractStartDate:     start,
+			Duration:              duration,
+			DurationUnits:         durationUnits,
+			BillingFrequency:      frequency,
+			BillingFrequencyUnits: billingUnits,
+		}
+	}
+
+	tests := []struct {
+		name         string
+		subscription models.Subscription
+		cycle        int
+		want         time.Time
+	}{
+		{"days", schedule(date(2024, time.February, 27), 30, "days", 30, "DAY"), 3, date(2024, time.March, 1)},
+		{"weeks", schedule(date(2024, time.December, 30), 4, "week", 4, "weeks"), 2, date(2025, time.January, 13)},
+		{"months", schedule(date(2024, time.March, 15), 12, "month", 12, "month"), 10, date(2025, time.January, 15)},
+		{"years", schedule(date(2024, time.February, 29), 3, "year", 3, "year"), 1, date(2025, time.February, 28)},
+		{"years back on the leap day", schedule(date(2024, time.February, 29), 8, "year", 8, "year"), 4, date(2028, time.February, 29)},
+		{"Jan 31 to Feb 28", schedule(date(2023, time.January, 31), 12, "month", 12, "month"), 1, date(2023, time.February, 28)},
+		{"Jan 31 to Feb 29 in a leap year", schedule(date(2024, time.January, 31), 12, "month", 12, "month"), 1, date(2024, time.February, 29)},
+		{"Jan 31 to Mar 31 without drift", schedule(date(2023, time.January, 31), 12, "month", 12, "month"), 2, date(2023, time.March, 31)},
+		{"yearly contract billed monthly", schedule(date(2023, time.January, 31), 1, "year", 12, "month"), 1, date(2023, time.February, 28)},
+		{"yearly contract billed quarterly in months", schedule(date(2024, time.January, 1), 1, "year", 4, "months"), 3, date(2024, time.October, 1)},
+		{"monthly contract billed weekly in days", schedule(date(2024, time.February, 1), 1, "month", 4, "week"), 2, date(2024, time.February, 15)},
+		{"contract end", schedule(date(2024, time.January, 31), 12, "month", 12, "month"), 12, date(2025, time.January, 31)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cycleBoundary(tt.subscription, tt.cycle)
+			if err != nil {
+				t.Fatalf("cycleBoundary: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("cycleBoundary(%d) = %v, want %v", tt.cycle, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	tests := []struct {
+		name         string
+		subscription models.Subscription
+		wantPeriod   Period
+		wantStatus   string
+	}{
+		{
+			name:         "first cycle",
+			subscription: subscribed(yearlyPlan(1, 12000), date(2023, time.January, 31), 0, 0),
+			wantPeriod:   Period{Start: date(2023, time.January, 31), End: date(2023, time.February, 28)},
+			wantStatus:   states.ACTIVE,
+		},
+		{
+			name:         "after a pause",
+			subscription: subscribed(yearlyPlan(1, 12000), date(2024, time.January, 1), 3, 2),
+			wantPeriod:   Period{Start: date(2024, time.June, 1), End: date(2024, time.July, 1)},
+			wantStatus:   states.ACTIVE,
+		},
+		{
+			name:         "last cycle finishes the subscription",
+			subscription: subscribed(yearlyPlan(1, 12000), date(2024, time.January, 1), 11, 0),
+			wantPeriod:   Period{Start: date(2024, time.December, 1), End: date(2025, time.January, 1)},
+			wantStatus:   states.FINISHED,
+		},
+		{
+			name:         "last cycle after a pause runs past the contract",
+			subscription: subscribed(yearlyPlan(1, 12000), date(2024, time.January, 1), 11, 1),
+			wantPeriod:   Period{Start: date(2025, time.January, 1), End: date(2025, time.February, 1)},
+			wantStatus:   states.FINISHED,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			period, next, err := Advance(tt.subscription)
+			if err != nil {
+				t.Fatalf("Advance: %v", err)
+			}
+			if period != tt.wantPeriod {
+				t.Errorf("Advance period = %v, want %v", period, tt.wantPeriod)
+			}
+			if next.BilledCycles != tt.subscription.BilledCycles+1 || next.SkippedCycles != tt.subscription.SkippedCycles {
+				t.Errorf("Advance cycles = %d billed, %d skipped, want %d, %d", next.BilledCycles, next.SkippedCycles,
+					tt.subscription.BilledCycles+1, tt.subscription.SkippedCycles)
+			}
+			if !next.NextBillingDate.Equal(tt.wantPeriod.End) || next.Status != tt.wantStatus {
+				t.Errorf("Advance = next billing %v, status %s, want %v, %s", next.NextBillingDate, next.Status, tt.wantPeriod.End, tt.wantStatus)
+			}
+		})
+	}
+
+	if _, _, err := Advance(models.Subscription{BillingFrequency: 12, DurationUnits: "month", BillingFrequencyUnits: "quarter"}); err == nil {
+		t.Error("Advance with an unknown billing unit succeeded")
+	}
+}
@@ -0,0 +1,141 @@
+package billing
+
+import (
+	"fmt"
+	"math"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+	"time"
+)
+
+// Proration is the result of moving a subscription to another plan part-way through a billing period.
+type Proration struct {
+	// Period is the unused remainder of the current billing period, starting on the change date
+	Period Period
+	// LineItems holds the credit for the old plan and the charge for the new plan over Period
+	LineItems []models.InvoiceLineItem
+	Total     money.Money
+	// Subscription is the subscription on the new plan, whose contract starts when Period ends
+	Subscription models.Subscription
+}
+
+// Prorate computes the proration for moving the subscription to newPlan on the given day. The customer
+// is credited for the days of the current, already billed period that fall after at and charged the
+// new plan's daily rate for the same days. The new plan's contract starts at the end of the current
+// period. A subscription that has not been billed yet has nothing to prorate and just starts over on
+// the new plan, with no line items.
+func Prorate(subscription models.Subscription, currentPlan, newPlan models.Plan, at time.Time) (Proration, error) {
+	if newPlan.Price.Currency != subscription.Price.Currency {
+		return Proration{}, money.ErrCurrencyMismatch
+	}
+
+	next := subscription
+	next.PlanID = newPlan.ID
+	next.Duration = newPlan.Duration
+	next.DurationUnits = newPlan.DurationUnits
+	next.BillingFrequency = newPlan.BillingFrequency
+	next.BillingFrequencyUnits = newPlan.BillingFrequencyUnits
+	next.Price = newPlan.Price
+	if next.Status != states.TRIALING {
+		next.Status = states.ACTIVE
+	}
+	next.BilledCycles = 0
+	next.SkippedCycles = 0
+	next.PausedCycles = 0
+
+	if subscription.BilledCycles == 0 {
+		next.ContractStartDate = subscription.NextBillingDate
+		next.NextBillingDate = subscription.NextBillingDate
+		return Proration{Subscription: next}, nil
+	}
+
+	current, err := currentPeriod(subscription)
+	if err != nil {
+		return Proration{}, err
+	}
+	if at.Before(current.Start) {
+		at = current.Start
+	}
+
+	next.ContractStartDate = current.End
+	next.NextBillingDate = current.End
+
+	remaining := days(at, current.End)
+	if remaining <= 0 {
+		return Proration{Period: Period{Start: current.End, End: current.End}, Subscription: next}, nil
+	}
+
+	firstCycle, err := CyclePeriod(next, 0)
+	if err != nil {
+		return Proration{}, err
+	}
+
+	currentDays, newDays := days(current.Start, current.End), days(firstCycle.Start, firstCycle.End)
+	if currentDays <= 0 || newDays <= 0 {
+		return Proration{}, fmt.Errorf("subscription %d: cannot prorate over an empty billing period", subscription.ID)
+	}
+
+	// the credit is based on what was actually billed for the current cycle, the charge on the new
+	// plan's first cycle; both are rounded to the minor unit
+	credit := CycleAmount(subscription, subscription.BilledCycles-1).MulRatio(int64(remaining), int64(currentDays))
+	charge := CycleAmount(next, 0).MulRatio(int64(remaining), int64(newDays))
+
+	total, err := charge.Sub(credit)
+	if err != nil {
+		return Proration{}, err
+	}
+
+	period := Period{Start: at, End: current.End}
+	description := fmt.Sprintf("%s - %s (%d days)",
+		period.Start.Format(states.TIME_LAYOUT), period.End.Format(states.TIME_LAYOUT), remaining)
+
+	return Proration{
+		Period: period,
+		LineItems: []models.InvoiceLineItem{
+			{
+				Name:        fmt.Sprintf("Unused time on %s", currentPlan.Name),
+				Description: description,
+				UnitCost:    credit.Neg(),
+				Quantity:    1,
+				Amount:      credit.Neg(),
+			},
+			{
+				Name:        fmt.Sprintf("Remaining time on %s", newPlan.Name),
+				Description: description,
+				UnitCost:    charge,
+				Quantity:    1,
+				Amount:      charge,
+			},
+		},
+		Total:        total,
+		Subscription: next,
+	}, nil
+}
+
+// currentPeriod returns the billed period the subscription is in, which is the one ending on its next
+// billing date. Cycles skipped by a pause keep their place in the schedule, so the period is looked up
+// by its end rather than counted from the billed cycles.
+func currentPeriod(subscription models.Subscription) (Period, error) {
+	last := int(subscription.BillingFrequency) + subscription.SkippedCycles
+	for cycle := 0; cycle < last; cycle++ {
+		period, err := CyclePeriod(subscription, cycle)
+		if err != nil {
+			return Period{}, err
+		}
+		if period.End.Equal(subscription.NextBillingDate) {
+			return period, nil
+		}
+		if period.End.After(subscription.NextBillingDate) {
+			break
+		}
+	}
+
+	return Period{}, fmt.Errorf("subscription %d: no billing period ends on %s", subscription.ID,
+		subscription.NextBillingDate.Format(states.TIME_LAYOUT))
+}
+
+// days returns the number of whole days between two dates
+func days(from, to time.Time) int {
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
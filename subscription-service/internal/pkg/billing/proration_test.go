@@ -0,0 +1,232 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// yearlyPlan is a twelve-month contract billed monthly at the given price in euro cents
+func yearlyPlan(id int, price int64) models.Plan {
+	return models.Plan{
+		ID:                    id,
+		Name:                  "Plan",
+		Duration:              12,
+		DurationUnits:         "month",
+		BillingFrequency:      12,
+		BillingFrequencyUnits: "month",
+		Price:                 money.New(price, "EUR"),
+	}
+}
+
+// subscribed returns a subscription to the plan starting on start with the given cycles billed and
+// skipped, and its next billing date at the start of its next cycle
+func subscribed(plan models.Plan, start time.Time, billed, skipped int) models.Subscription {
+	subscription := models.Subscription{
+		ID:                    1,
+		PlanID:                plan.ID,
+		ContractStartDate:     start,
+		Duration:              plan.Duration,
+		DurationUnits:         plan.DurationUnits,
+		BillingFrequency:      plan.BillingFrequency,
+		BillingFrequencyUnits: plan.BillingFrequencyUnits,
+		Price:                 plan.Price,
+		Status:                states.ACTIVE,
+		BilledCycles:          billed,
+		SkippedCycles:         skipped,
+	}
+	subscription.NextBillingDate, _ = CycleStart(subscription, billed+skipped)
+	return subscription
+}
+
+func TestProrate(t *testing.T) {
+	current := yearlyPlan(1, 12000)
+	upgrade := yearlyPlan(2, 24000)
+	downgrade := yearlyPlan(3, 6000)
+
+	tests := []struct {
+		name         string
+		subscription models.Subscription
+		newPlan      models.Plan
+		at           time.Time
+		wantPeriod   Period
+		wantCredit   int64
+		wantCharge   int64
+		wantTotal    int64
+	}{
+		{
+			// 16 of March's 31 days are credited and charged at April's 30 days on the new plan
+			name:         "upgrade",
+			subscription: subscribed(current, date(2024, time.January, 1), 3, 0),
+			newPlan:      upgrade,
+			at:           date(2024, time.March, 16),
+			wantPeriod:   Period{Start: date(2024, time.March, 16), End: date(2024, time.April, 1)},
+			wantCredit:   516,
+			wantCharge:   1067,
+			wantTotal:    551,
+		},
+		{
+			name:         "downgrade",
+			subscription: subscribed(current, date(2024, time.January, 1), 3, 0),
+			newPlan:      downgrade,
+			at:           date(2024, time.March, 16),
+			wantPeriod:   Period{Start: date(2024, time.March, 16), End: date(2024, time.April, 1)},
+			wantCredit:   516,
+			wantCharge:   267,
+			wantTotal:    -249,
+		},
+		{
+			// the first cycle from Jan 31 ends on Feb 29, and the new plan's on Mar 29
+			name:         "month-end clamping",
+			subscription: subscribed(current, date(2024, time.January, 31), 1, 0),
+			newPlan:      upgrade,
+			at:           date(2024, time.February, 15),
+			wantPeriod:   Period{Start: date(2024, time.February, 15), End: date(2024, time.February, 29)},
+			wantCredit:   483,
+			wantCharge:   966,
+			wantTotal:    483,
+		},
+		{
+			// April and May were paused, so the fourth billed cycle is June
+			name:         "previously skipped cycle",
+			subscription: subscribed(current, date(2024, time.January, 1), 4, 2),
+			newPlan:      upgrade,
+			at:           date(2024, time.June, 16),
+			wantPeriod:   Period{Start: date(2024, time.June, 16), End: date(2024, time.July, 1)},
+			wantCredit:   500,
+			wantCharge:   968,
+			wantTotal:    468,
+		},
+		{
+			name:         "final cycle",
+			subscription: subscribed(current, date(2024, time.January, 1), 12, 0),
+			newPlan:      upgrade,
+			at:           date(2024, time.December, 17),
+			wantPeriod:   Period{Start: date(2024, time.December, 17), End: date(2025, time.January, 1)},
+			wantCredit:   484,
+			wantCharge:   968,
+			wantTotal:    484,
+		},
+		{
+			// a change before the current period started prorates the whole period
+			name:         "change dated before the period",
+			subscription: subscribed(current, date(2024, time.January, 1), 3, 0),
+			newPlan:      upgrade,
+			at:           date(2024, time.February, 20),
+			wantPeriod:   Period{Start: date(2024, time.March, 1), End: date(2024, time.April, 1)},
+			wantCredit:   1000,
+			wantCharge:   2067,
+			wantTotal:    1067,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Prorate(tt.subscription, current, tt.newPlan, tt.at)
+			if err != nil {
+				t.Fatalf("Prorate: %v", err)
+			}
+
+			if got.Period != tt.wantPeriod {
+				t.Errorf("Prorate period = %v, want %v", got.Period, tt.wantPeriod)
+			}
+			if len(got.LineItems) != 2 {
+				t.Fatalf("Prorate returned %d line items, want 2", len(got.LineItems))
+			}
+			if credit := got.LineItems[0].Amount.Amount; credit != -tt.wantCredit {
+				t.Errorf("Prorate credit = %d, want %d", credit, -tt.wantCredit)
+			}
+			if charge := got.LineItems[1].Amount.Amount; charge != tt.wantCharge {
+				t.Errorf("Prorate charge = %d, want %d", charge, tt.wantCharge)
+			}
+			if got.Total.Amount != tt.wantTotal {
+				t.Errorf("Prorate total = %d, want %d", got.Total.Amount, tt.wantTotal)
+			}
+
+			next := got.Subscription
+			if next.PlanID != tt.newPlan.ID || next.Price != tt.newPlan.Price || next.BilledCycles != 0 || next.SkippedCycles != 0 {
+				t.Errorf("Prorate subscription = %+v, want a fresh subscription to plan %d", next, tt.newPlan.ID)
+			}
+			if !next.ContractStartDate.Equal(tt.wantPeriod.End) || !next.NextBillingDate.Equal(tt.wantPeriod.End) {
+				t.Errorf("Prorate contract starts %v and bills %v, want both at %v",
+					next.ContractStartDate, next.NextBillingDate, tt.wantPeriod.End)
+			}
+		})
+	}
+}
+
+func TestProrateWithoutLineItems(t *testing.T) {
+	current := yearlyPlan(1, 12000)
+	upgrade := yearlyPlan(2, 24000)
+
+	tests := []struct {
+		name         string
+		subscription models.Subscription
+		at           time.Time
+		wantStart    time.Time
+	}{
+		{"not billed yet", subscribed(current, date(2024, time.January, 1), 0, 0), date(2023, time.December, 20), date(2024, time.January, 1)},
+		{"change on the next billing date", subscribed(current, date(2024, time.January, 1), 3, 0), date(2024, time.April, 1), date(2024, time.April, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Prorate(tt.subscription, current, upgrade, tt.at)
+			if err != nil {
+				t.Fatalf("Prorate: %v", err)
+			}
+			if len(got.LineItems) != 0 {
+				t.Errorf("Prorate returned %d line items, want none", len(got.LineItems))
+			}
+			if !got.Subscription.ContractStartDate.Equal(tt.wantStart) || got.Subscription.PlanID != upgrade.ID {
+				t.Errorf("Prorate subscription starts %v on plan %d, want %v on plan %d",
+					got.Subscription.ContractStartDate, got.Subscription.PlanID, tt.wantStart, upgrade.ID)
+			}
+		})
+	}
+}
+
+func TestProrateErrors(t *testing.T) {
+	current := yearlyPlan(1, 12000)
+	subscription := subscribed(current, date(2024, time.January, 1), 3, 0)
+
+	dollars := yearlyPlan(2, 24000)
+	dollars.Price = money.New(24000, "USD")
+
+	empty := yearlyPlan(3, 24000)
+	empty.Duration = 0
+
+	misaligned := subscription
+	misaligned.NextBillingDate = date(2024, time.April, 5)
+
+	tests := []struct {
+		name         string
+		subscription models.Subscription
+		newPlan      models.Plan
+		wantErr      error
+	}{
+		{"other currency", subscription, dollars, money.ErrCurrencyMismatch},
+		{"empty new billing period", subscription, empty, nil},
+		{"next billing date between periods", misaligned, yearlyPlan(2, 24000), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Prorate(tt.subscription, current, tt.newPlan, date(2024, time.March, 16))
+			if err == nil {
+				t.Fatal("Prorate succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Prorate error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,35 +1,41 @@
 package invoicegenerator
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"subscription-service/internal/constants/models"
-
-	uuid "github.com/satori/go.uuid"
+	"subscription-service/internal/pkg/money"
 
 	generator "github.com/angelodlfrtr/go-invoice-generator"
 )
 
 type InvoiceGenerator struct {
 	CompanyName    string
-	Reference      string
 	Version        string
 	CompanyAddress models.Address
 }
 
-func NewInvoiceGenerator(CompanyName, Reference, Version string, CompanyAddress models.Address) InvoiceGenerator {
+func NewInvoiceGenerator(CompanyName, Version string, CompanyAddress models.Address) InvoiceGenerator {
 	return InvoiceGenerator{
 		CompanyName:    CompanyName,
-		Reference:      Reference,
 		Version:        Version,
 		CompanyAddress: CompanyAddress,
 	}
 }
-func (ig InvoiceGenerator) Generate(invoice models.Invoice) (string, error) {
+
+// Generate renders the invoice as a PDF and returns its content. The output only depends on the
+// invoice, so a lost PDF can be rendered again byte for byte.
+func (ig InvoiceGenerator) Generate(invoice models.Invoice) ([]byte, error) {
 	doc, _ := generator.New(generator.Invoice, &generator.Options{
-		TextTypeInvoice: "INVOICE",
-		AutoPrint:       true,
+		TextTypeInvoice:   "INVOICE",
+		TextTotalTotal:    "NET",
+		TextTotalTax:      "VAT",
+		TextTotalWithTax:  "GROSS",
+		AutoPrint:         true,
+		CurrencySymbol:    invoice.Currency + " ",
+		CurrencyPrecision: money.Exponent(invoice.Currency),
 	})
 
 	doc.SetHeader(&generator.HeaderFooter{
@@ -42,7 +48,7 @@ func (ig InvoiceGenerator) Generate(invoice models.Invoice) (string, error) {
 		Pagination: true,
 	})
 
-	doc.SetRef(ig.Reference)
+	doc.SetRef(invoice.Number)
 	doc.SetVersion(ig.Version)
 
 	doc.SetDescription(invoice.Description)
@@ -68,8 +74,14 @@ func (ig InvoiceGenerator) Generate(invoice models.Invoice) (string, error) {
 		},
 	})
 
+	var customerInfo []string
+	if invoice.CustomerAddress.VatID != "" {
+		customerInfo = append(customerInfo, fmt.Sprintf("VAT ID: %s", invoice.CustomerAddress.VatID))
+	}
+
 	doc.SetCustomer(&generator.Contact{
-		Name: invoice.CustomerName,
+		Name:           invoice.CustomerName,
+		AddtionnalInfo: customerInfo,
 		Address: &generator.Address{
 			Address:    invoice.CustomerAddress.Address,
 			PostalCode: invoice.CustomerAddress.PostalCode,
@@ -85,21 +97,28 @@ func (ig InvoiceGenerator) Generate(invoice models.Invoice) (string, error) {
 			UnitCost:    item.UnitCost,
 			Quantity:    item.Quantity,
 			Tax: &generator.Tax{
-				Percent: item.Tax,
+				Amount: item.TaxAmount,
 			},
 		})
 	}
 
 	pdf, err := doc.Build()
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		return nil, err
 	}
 
-	id := uuid.NewV4().String()
-	err = pdf.OutputFileAndClose(fmt.Sprintf("../../../temp/%s.pdf", id))
+	// fix everything fpdf would take from the clock or from map iteration order, so that rendering
+	// the same invoice again produces the same bytes
+	pdf.SetCatalogSort(true)
+	pdf.SetCreationDate(invoice.IssuedAt)
+	pdf.SetModificationDate(invoice.IssuedAt)
+
+	var buf bytes.Buffer
+	err = pdf.Output(&buf)
 	if err != nil {
 		log.Println(err)
-		return "", err
+		return nil, err
 	}
-	return id, nil
+	return buf.Bytes(), nil
 }
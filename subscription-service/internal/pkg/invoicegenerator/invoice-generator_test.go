@@ -0,0 +1,59 @@
+package invoicegenerator
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"subscription-service/internal/constants/models"
+)
+
+func testInvoice() models.Invoice {
+	return models.Invoice{
+		Number:       "INV-2024-000042",
+		Date:         "2024-03-01",
+		IssuedAt:     time.Date(2024, time.March, 1, 6, 30, 15, 0, time.UTC),
+		PaymentTerm:  "2024-03-15",
+		CustomerName: "Ada Lovelace",
+		Description:  "Billing period 2024-03-01 - 2024-04-01",
+		Notes:        "Reverse charge",
+		Currency:     "EUR",
+		CustomerAddress: models.Address{
+			Address:    "Main St 1",
+			PostalCode: "75001",
+			City:       "Paris",
+			Country:    "FR",
+			VatID:      "FR12345678901",
+		},
+		Items: []models.InvoiceItem{
+			{Name: "Plan", Description: "Monthly", UnitCost: "10.00", Quantity: "1", TaxAmount: "0.00", Discount: "0.00"},
+			{Name: "Discount SAVE", Description: "20% off", UnitCost: "-2.00", Quantity: "1", TaxAmount: "0.00", Discount: "0.00"},
+		},
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	ig := NewInvoiceGenerator("Movido", "1.0", models.Address{Address: "Hauptstr. 1", City: "Berlin", Country: "DE"})
+
+	first, err := ig.Generate(testInvoice())
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	second, err := ig.Generate(testInvoice())
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("rendering the same invoice twice produced different PDFs")
+	}
+
+	changed := testInvoice()
+	changed.IssuedAt = changed.IssuedAt.Add(time.Second)
+	third, err := ig.Generate(changed)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if bytes.Equal(first, third) {
+		t.Error("the PDF does not record the invoice's issue time")
+	}
+}
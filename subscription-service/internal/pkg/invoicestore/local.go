@@ -0,0 +1,81 @@
+package invoicestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore keeps invoice PDFs in a directory of the local filesystem, which should be a volume that
+// outlives the container
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore returns a LocalStore writing below dir, creating the directory if needed
+func NewLocalStore(dir string) (LocalStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return LocalStore{}, err
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return LocalStore{}, err
+	}
+	return LocalStore{dir: dir}, nil
+}
+
+// Put writes data to a temporary file and renames it into place, so that readers never see a
+// partially written PDF
+func (s LocalStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s LocalStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// path maps key to a file below the store's directory, rejecting keys that would escape it
+func (s LocalStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid invoice store key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
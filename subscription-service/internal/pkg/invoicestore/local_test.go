@@ -0,0 +1,74 @@
+package invoicestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	store, err := NewLocalStore(filepath.Join(t.TempDir(), "invoices"))
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	ctx := context.Background()
+	key := "invoices/ab/abc.pdf"
+	for _, pdf := range [][]byte{[]byte("%PDF-1.3 first"), []byte("%PDF-1.3 replaced")} {
+		if err := store.Put(ctx, key, pdf); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		got, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !bytes.Equal(got, pdf) {
+			t.Errorf("Get = %q, want %q", got, pdf)
+		}
+	}
+
+	// the temporary upload files are renamed or removed
+	entries, err := os.ReadDir(filepath.Join(store.dir, "invoices", "ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the PDF", len(entries))
+	}
+}
+
+func TestLocalStoreNotFound(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	if _, err := store.Get(context.Background(), "invoices/ab/missing.pdf"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	base := t.TempDir()
+	store, err := NewLocalStore(filepath.Join(base, "invoices"))
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, key := range []string{"", "../outside.pdf", "invoices/../../outside.pdf", "/etc/outside.pdf"} {
+		if err := store.Put(ctx, key, []byte("%PDF")); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) = %v, want an invalid key error", key, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(base, "outside.pdf")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a file was written outside the store: %v", err)
+	}
+}
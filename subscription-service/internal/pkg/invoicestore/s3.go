@@ -0,0 +1,243 @@
+package invoicestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3Timeout bounds a single request to the object store
+	s3Timeout = 30 * time.Second
+	// emptyPayloadHash is the SHA-256 of an empty request body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config describes an S3-compatible bucket. Objects are addressed path-style
+// (Endpoint/Bucket/key), which AWS S3 as well as MinIO and similar stand-ins support.
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Store keeps invoice PDFs in an S3-compatible bucket. Requests are signed with AWS Signature
+// Version 4 including the payload hash, so the store rejects uploads corrupted in transit.
+type S3Store struct {
+	endpoint *url.URL
+	config   S3Config
+	client   *http.Client
+}
+
+// NewS3Store returns an S3Store for the configured bucket, creating the bucket if it does not exist
+func NewS3Store(config S3Config) (S3Store, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return S3Store{}, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return S3Store{}, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return S3Store{}, errors.New("S3 bucket is not set")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	store := S3Store{
+		endpoint: endpoint,
+		config:   config,
+		client:   &http.Client{Timeout: s3Timeout},
+	}
+	if err := store.ensureBucket(context.Background()); err != nil {
+		return S3Store{}, err
+	}
+	return store, nil
+}
+
+func (s S3Store) Put(ctx context.Context, key string, data []byte) error {
+	res, err := s.do(ctx, http.MethodPut, s.objectPath(key), data, map[string]string{"Content-Type": "application/pdf"})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+func (s S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, s.objectPath(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// ensureBucket creates the bucket unless it already exists
+func (s S3Store) ensureBucket(ctx context.Context) error {
+	res, err := s.do(ctx, http.MethodHead, "/"+s.config.Bucket, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("checking S3 bucket %s: %s", s.config.Bucket, res.Status)
+	}
+
+	res, err = s.do(ctx, http.MethodPut, "/"+s.config.Bucket, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// another replica may have created the bucket in the meantime
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusConflict {
+		return responseError(res)
+	}
+	return nil
+}
+
+func (s S3Store) objectPath(key string) string {
+	return "/" + s.config.Bucket + "/" + key
+}
+
+// do sends a signed request for the path below the endpoint
+func (s S3Store) do(ctx context.Context, method string, path string, body []byte, headers map[string]string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = uriEncode(u.Path, false)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	return s.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering the host and all headers of req
+func (s S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes the query parameters sorted by name as Signature Version 4 requires
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of RFC 3986, and slashes
+// unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// responseError turns an unexpected S3 response into an error including the start of its body
+func responseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("S3 request %s %s failed: %s %s", res.Request.Method, res.Request.URL.Path, res.Status, strings.TrimSpace(string(body)))
+}
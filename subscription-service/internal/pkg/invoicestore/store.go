@@ -0,0 +1,61 @@
+package invoicestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when no PDF is stored under a key
+	ErrNotFound = errors.New("invoice PDF not found")
+	// ErrChecksumMismatch is returned when a stored PDF no longer matches the checksum it was stored with
+	ErrChecksumMismatch = errors.New("invoice PDF does not match its checksum")
+)
+
+// InvoiceStore keeps rendered invoice PDFs under the keys returned by Save
+type InvoiceStore interface {
+	// Put stores data under key, replacing what was stored there
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the data stored under key, or ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// Checksum returns the hex encoded SHA-256 of the PDF
+func Checksum(pdf []byte) string {
+	sum := sha256.Sum256(pdf)
+	return hex.EncodeToString(sum[:])
+}
+
+// Key returns the content-addressed key of a PDF with the given checksum. Identical documents share
+// a key, so storing a PDF again never overwrites a different one.
+func Key(checksum string) string {
+	return fmt.Sprintf("invoices/%s/%s.pdf", checksum[:2], checksum)
+}
+
+// Save stores the PDF under its content-addressed key and returns the key and checksum to record
+// with the invoice
+func Save(ctx context.Context, store InvoiceStore, pdf []byte) (key string, checksum string, err error) {
+	checksum = Checksum(pdf)
+	key = Key(checksum)
+
+	if err = store.Put(ctx, key, pdf); err != nil {
+		return "", "", err
+	}
+	return key, checksum, nil
+}
+
+// Load returns the PDF stored under key after verifying it against checksum
+func Load(ctx context.Context, store InvoiceStore, key string, checksum string) ([]byte, error) {
+	pdf, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if Checksum(pdf) != checksum {
+		return nil, ErrChecksumMismatch
+	}
+	return pdf, nil
+}
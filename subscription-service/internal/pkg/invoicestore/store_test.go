@@ -0,0 +1,42 @@
+package invoicestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	ctx := context.Background()
+	pdf := []byte("%PDF-1.3 invoice")
+	key, checksum, err := Save(ctx, store, pdf)
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if want := Key(Checksum(pdf)); key != want {
+		t.Errorf("key = %q, want the content-addressed %q", key, want)
+	}
+
+	got, err := Load(ctx, store, key, checksum)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !bytes.Equal(got, pdf) {
+		t.Errorf("Load = %q, want %q", got, pdf)
+	}
+
+	if err := os.WriteFile(filepath.Join(store.dir, filepath.FromSlash(key)), []byte("%PDF-1.3 tampered"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(ctx, store, key, checksum); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Load = %v, want ErrChecksumMismatch", err)
+	}
+}
@@ -0,0 +1,219 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/billing"
+	"subscription-service/internal/storage/db"
+	"time"
+)
+
+var (
+	// ErrInvalidTransition is returned when the requested action is not allowed in the subscription's status
+	ErrInvalidTransition = errors.New("action is not allowed in the subscription's current status")
+	// ErrInvalidPause is returned for pauses that are not at least one whole cycle within the contract
+	ErrInvalidPause = errors.New("a subscription can only be paused for whole remaining cycles")
+)
+
+// transitions lists the statuses a subscription may move to from each status. FINISHED and
+// CANCELED are final.
+var transitions = map[string][]string{
+	states.PENDING:  {states.ACTIVE, states.CANCELED},
+	states.INACTIVE: {states.ACTIVE, states.CANCELED},
+	states.ACTIVE:   {states.ACTIVE, states.PAUSED, states.CANCELED, states.FINISHED},
+	states.PAUSED:   {states.ACTIVE, states.CANCELED},
+	states.TRIALING: {states.ACTIVE, states.CANCELED},
+}
+
+// CanTransition reports whether a subscription may move from one status to another
+func CanTransition(from, to string) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancel returns the subscription canceled as of now. With atPeriodEnd the subscription stays
+// active, or in its trial, until its next billing date and is canceled by the scheduler instead of
+// being billed.
+func Cancel(subscription models.Subscription, atPeriodEnd bool, now time.Time) (models.Subscription, error) {
+	next := subscription
+
+	if atPeriodEnd {
+		if !running(subscription) || subscription.CancelAtPeriodEnd {
+			return subscription, ErrInvalidTransition
+		}
+		next.CancelAtPeriodEnd = true
+		return next, nil
+	}
+
+	if !CanTransition(subscription.Status, states.CANCELED) {
+		return subscription, ErrInvalidTransition
+	}
+	next.Status = states.CANCELED
+	next.CancelAtPeriodEnd = false
+	next.PausedCycles = 0
+	next.CanceledAt = &now
+
+	return next, nil
+}
+
+// Pause returns the subscription paused for the given number of billing cycles. The pause starts at
+// the next billing date, so the period already paid for is not affected, and the skipped cycles are
+// appended to the end of the contract. Billing resumes automatically once the pause is over.
+func Pause(subscription models.Subscription, cycles int) (models.Subscription, error) {
+	if !CanTransition(subscription.Status, states.PAUSED) || subscription.CancelAtPeriodEnd {
+		return subscription, ErrInvalidTransition
+	}
+
+	remaining := int(subscription.BillingFrequency) - subscription.BilledCycles
+	if cycles <= 0 || cycles > remaining {
+		return subscription, ErrInvalidPause
+	}
+
+	resumesAt, err := billing.CycleStart(subscription, billing.CurrentCycle(subscription)+cycles)
+	if err != nil {
+		return subscription, err
+	}
+
+	next := subscription
+	next.Status = states.PAUSED
+	next.SkippedCycles += cycles
+	next.PausedCycles = cycles
+	next.NextBillingDate = resumesAt
+
+	return next, nil
+}
+
+// Resume returns the subscription active again. A paused subscription resumes with the first skipped
+// cycle that has not started by now, giving back the rest of the pause; one that is due to be canceled
+// at period end keeps running instead.
+func Resume(subscription models.Subscription, now time.Time) (models.Subscription, error) {
+	next := subscription
+
+	if running(subscription) {
+		if !subscription.CancelAtPeriodEnd {
+			return subscription, ErrInvalidTransition
+		}
+		next.CancelAtPeriodEnd = false
+		return next, nil
+	}
+
+	if subscription.Status != states.PAUSED {
+		return subscription, ErrInvalidTransition
+	}
+
+	cycle := billing.CurrentCycle(subscription)
+	pauseStart := cycle - subscription.PausedCycles
+	resumesAt := subscription.NextBillingDate
+
+	for cycle > pauseStart {
+		start, err := billing.CycleStart(subscription, cycle-1)
+		if err != nil {
+			return subscription, err
+		}
+		if start.Before(now) {
+			break
+		}
+		cycle--
+		resumesAt = start
+	}
+
+	next.Status = states.ACTIVE
+	next.SkippedCycles -= billing.CurrentCycle(subscription) - cycle
+	next.PausedCycles = 0
+	next.NextBillingDate = resumesAt
+
+	return next, nil
+}
+
+// EndTrial returns the subscription active at the end of its free trial, ready for its first invoice
+func EndTrial(subscription models.Subscription) (models.Subscription, error) {
+	if subscription.Status != states.TRIALING || subscription.CancelAtPeriodEnd {
+		return subscription, ErrInvalidTransition
+	}
+
+	next := subscription
+	next.Status = states.ACTIVE
+	return next, nil
+}
+
+// running reports whether the subscription is active or in its free trial
+func running(subscription models.Subscription) bool {
+	return subscription.Status == states.ACTIVE || subscription.Status == states.TRIALING
+}
+
+// Service applies lifecycle actions to stored subscriptions and records them in the audit trail.
+type Service struct {
+	subscriptionPersistence db.SubscriptionPersistence
+}
+
+func NewService(subscriptionPersistence db.SubscriptionPersistence) Service {
+	return Service{
+		subscriptionPersistence: subscriptionPersistence,
+	}
+}
+
+// Cancel cancels the subscription immediately or at the end of its current period. actorID is the
+// user requesting the change, or zero for the scheduler.
+func (s *Service) Cancel(subscription models.Subscription, atPeriodEnd bool, actorID int) (models.Subscription, error) {
+	next, err := Cancel(subscription, atPeriodEnd, time.Now())
+	if err != nil {
+		return subscription, err
+	}
+
+	action := states.SUBSCRIPTION_CANCEL
+	if atPeriodEnd {
+		action = states.SUBSCRIPTION_CANCEL_AT_PERIOD_END
+	}
+
+	return next, s.apply(subscription, next, action, actorID, "")
+}
+
+// Pause pauses the subscription for the given number of billing cycles
+func (s *Service) Pause(subscription models.Subscription, cycles int, actorID int) (models.Subscription, error) {
+	next, err := Pause(subscription, cycles)
+	if err != nil {
+		return subscription, err
+	}
+
+	detail := fmt.Sprintf("%d cycles, resumes %s", cycles, next.NextBillingDate.Format(states.TIME_LAYOUT))
+	return next, s.apply(subscription, next, states.SUBSCRIPTION_PAUSE, actorID, detail)
+}
+
+// Resume ends a pause early or withdraws a pending cancellation
+func (s *Service) Resume(subscription models.Subscription, actorID int) (models.Subscription, error) {
+	next, err := Resume(subscription, time.Now())
+	if err != nil {
+		return subscription, err
+	}
+
+	detail := fmt.Sprintf("next billing %s", next.NextBillingDate.Format(states.TIME_LAYOUT))
+	return next, s.apply(subscription, next, states.SUBSCRIPTION_RESUME, actorID, detail)
+}
+
+// EndTrial activates the subscription once its free trial is over
+func (s *Service) EndTrial(subscription models.Subscription, actorID int) (models.Subscription, error) {
+	next, err := EndTrial(subscription)
+	if err != nil {
+		return subscription, err
+	}
+
+	detail := fmt.Sprintf("first billing %s", next.NextBillingDate.Format(states.TIME_LAYOUT))
+	return next, s.apply(subscription, next, states.SUBSCRIPTION_TRIAL_END, actorID, detail)
+}
+
+func (s *Service) apply(from, to models.Subscription, action string, actorID int, detail string) error {
+	return s.subscriptionPersistence.Transition(models.SubscriptionChange{From: from, To: to}, models.SubscriptionEvent{
+		SubscriptionID: from.ID,
+		Action:         action,
+		FromStatus:     from.Status,
+		ToStatus:       to.Status,
+		ActorID:        actorID,
+		Detail:         detail,
+	})
+}
@@ -0,0 +1,190 @@
+package lifecycle
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// monthly is a twelve-month contract billed monthly from Jan 1 with three cycles billed
+func monthly(status string) models.Subscription {
+	return models.Subscription{
+		ContractStartDate:     date(2024, time.January, 1),
+		Duration:              12,
+		DurationUnits:         "month",
+		BillingFrequency:      12,
+		BillingFrequencyUnits: "month",
+		Status:                status,
+		BilledCycles:          3,
+		NextBillingDate:       date(2024, time.April, 1),
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	all := []string{states.PENDING, states.INACTIVE, states.ACTIVE, states.PAUSED, states.TRIALING, states.CANCELED, states.FINISHED}
+	allowed := map[[2]string]bool{
+		{states.PENDING, states.ACTIVE}:    true,
+		{states.PENDING, states.CANCELED}:  true,
+		{states.INACTIVE, states.ACTIVE}:   true,
+		{states.INACTIVE, states.CANCELED}: true,
+		{states.ACTIVE, states.ACTIVE}:     true,
+		{states.ACTIVE, states.PAUSED}:     true,
+		{states.ACTIVE, states.CANCELED}:   true,
+		{states.ACTIVE, states.FINISHED}:   true,
+		{states.PAUSED, states.ACTIVE}:     true,
+		{states.PAUSED, states.CANCELED}:   true,
+		{states.TRIALING, states.ACTIVE}:   true,
+		{states.TRIALING, states.CANCELED}: true,
+	}
+
+	for _, from := range all {
+		for _, to := range all {
+			if got, want := CanTransition(from, to), allowed[[2]string{from, to}]; got != want {
+				t.Errorf("CanTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	now := date(2024, time.March, 15)
+	pending := monthly(states.ACTIVE)
+	pending.CancelAtPeriodEnd = true
+
+	tests := []struct {
+		name        string
+		from        models.Subscription
+		atPeriodEnd bool
+		wantStatus  string
+		wantPending bool
+		wantErr     error
+	}{
+		{"active now", monthly(states.ACTIVE), false, states.CANCELED, false, nil},
+		{"paused now", monthly(states.PAUSED), false, states.CANCELED, false, nil},
+		{"active at period end", monthly(states.ACTIVE), true, states.ACTIVE, true, nil},
+		{"trialing at period end", monthly(states.TRIALING), true, states.TRIALING, true, nil},
+		{"pending cancellation now", pending, false, states.CANCELED, false, nil},
+		{"pending cancellation again", pending, true, "", false, ErrInvalidTransition},
+		{"paused at period end", monthly(states.PAUSED), true, "", false, ErrInvalidTransition},
+		{"finished", monthly(states.FINISHED), false, "", false, ErrInvalidTransition},
+		{"canceled", monthly(states.CANCELED), false, "", false, ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Cancel(tt.from, tt.atPeriodEnd, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Cancel error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Status != tt.wantStatus || got.CancelAtPeriodEnd != tt.wantPending {
+				t.Errorf("Cancel = %s pending %v, want %s pending %v", got.Status, got.CancelAtPeriodEnd, tt.wantStatus, tt.wantPending)
+			}
+			if canceled := got.CanceledAt != nil; canceled != (tt.wantStatus == states.CANCELED) {
+				t.Errorf("CanceledAt = %v for status %s", got.CanceledAt, got.Status)
+			}
+		})
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	paused, err := Pause(monthly(states.ACTIVE), 2)
+	if err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	if paused.Status != states.PAUSED || paused.SkippedCycles != 2 || paused.PausedCycles != 2 {
+		t.Errorf("Pause = %s skipped %d paused %d, want PAUSED skipped 2 paused 2", paused.Status, paused.SkippedCycles, paused.PausedCycles)
+	}
+	if want := date(2024, time.June, 1); !paused.NextBillingDate.Equal(want) {
+		t.Errorf("Pause resumes %s, want %s", paused.NextBillingDate, want)
+	}
+
+	// resuming during the first skipped cycle gives back the second one
+	resumed, err := Resume(paused, date(2024, time.April, 10))
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if resumed.Status != states.ACTIVE || resumed.SkippedCycles != 1 || resumed.PausedCycles != 0 {
+		t.Errorf("Resume = %s skipped %d paused %d, want ACTIVE skipped 1 paused 0", resumed.Status, resumed.SkippedCycles, resumed.PausedCycles)
+	}
+	if want := date(2024, time.May, 1); !resumed.NextBillingDate.Equal(want) {
+		t.Errorf("Resume bills next on %s, want %s", resumed.NextBillingDate, want)
+	}
+
+	// resuming before the pause started gives back all of it
+	resumed, err = Resume(paused, date(2024, time.March, 20))
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if resumed.SkippedCycles != 0 || !resumed.NextBillingDate.Equal(date(2024, time.April, 1)) {
+		t.Errorf("Resume = skipped %d next %s, want skipped 0 next 2024-04-01", resumed.SkippedCycles, resumed.NextBillingDate)
+	}
+}
+
+func TestPauseRejected(t *testing.T) {
+	pending := monthly(states.ACTIVE)
+	pending.CancelAtPeriodEnd = true
+
+	tests := []struct {
+		name    string
+		from    models.Subscription
+		cycles  int
+		wantErr error
+	}{
+		{"zero cycles", monthly(states.ACTIVE), 0, ErrInvalidPause},
+		{"past contract end", monthly(states.ACTIVE), 10, ErrInvalidPause},
+		{"pending cancellation", pending, 1, ErrInvalidTransition},
+		{"already paused", monthly(states.PAUSED), 1, ErrInvalidTransition},
+		{"trialing", monthly(states.TRIALING), 1, ErrInvalidTransition},
+		{"canceled", monthly(states.CANCELED), 1, ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Pause(tt.from, tt.cycles); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Pause error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResumeWithdrawsPendingCancellation(t *testing.T) {
+	pending := monthly(states.ACTIVE)
+	pending.CancelAtPeriodEnd = true
+
+	got, err := Resume(pending, date(2024, time.March, 15))
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if got.Status != states.ACTIVE || got.CancelAtPeriodEnd {
+		t.Errorf("Resume = %s pending %v, want ACTIVE without pending cancellation", got.Status, got.CancelAtPeriodEnd)
+	}
+
+	if _, err := Resume(monthly(states.ACTIVE), date(2024, time.March, 15)); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Resume of a running subscription = %v, want ErrInvalidTransition", err)
+	}
+}
+
+func TestEndTrial(t *testing.T) {
+	got, err := EndTrial(monthly(states.TRIALING))
+	if err != nil || got.Status != states.ACTIVE {
+		t.Errorf("EndTrial = %s, %v, want ACTIVE", got.Status, err)
+	}
+
+	canceling := monthly(states.TRIALING)
+	canceling.CancelAtPeriodEnd = true
+	for _, from := range []models.Subscription{monthly(states.ACTIVE), canceling} {
+		if _, err := EndTrial(from); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("EndTrial(%s pending %v) = %v, want ErrInvalidTransition", from.Status, from.CancelAtPeriodEnd, err)
+		}
+	}
+}
@@ -2,14 +2,41 @@ package mailer
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
+	netmail "net/mail"
+	"net/textproto"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
 	mail "github.com/xhit/go-simple-mail/v2"
 )
 
+// ErrInvalidRecipient is returned for a recipient address that cannot be parsed
+var ErrInvalidRecipient = errors.New("invalid recipient address")
+
+// permanentReplies are the SMTP replies rejecting the recipient mailbox itself (RFC 5321, RFC 7504)
+var permanentReplies = map[int]bool{
+	550: true, // mailbox unavailable
+	551: true, // user not local
+	553: true, // mailbox name not allowed
+	556: true, // domain does not accept mail
+}
+
+// IsPermanent reports whether sending failed because of the recipient's address, so that sending
+// the message again cannot succeed. Any other failure, such as the SMTP server being unreachable or
+// rejecting our credentials, may go away and is considered transient.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrInvalidRecipient) {
+		return true
+	}
+
+	var reply *textproto.Error
+	return errors.As(err, &reply) && permanentReplies[reply.Code]
+}
+
 type Mail struct {
 	Domain      string
 	Host        string
@@ -21,14 +48,23 @@ type Mail struct {
 	FromName    string
 }
 
+// File is an attachment kept in memory
+type File struct {
+	Name     string
+	MimeType string
+	Data     []byte
+}
+
 type Message struct {
 	From        string
 	FromName    string
 	To          string
 	Subject     string
 	Attachments []string
-	Data        any
-	DataMap     map[string]any
+	// Files are attached from memory rather than read from a path
+	Files   []File
+	Data    any
+	DataMap map[string]any
 }
 
 func (m *Mail) SendSMTPMessage(msg Message) error {
@@ -41,6 +77,10 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 		msg.FromName = m.FromName
 	}
 
+	if _, err := netmail.ParseAddress(msg.To); err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidRecipient, msg.To, err)
+	}
+
 	data := map[string]any{
 		"message": msg.Data,
 	}
@@ -90,6 +130,10 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 		}
 	}
 
+	for _, file := range msg.Files {
+		email.Attach(&mail.File{Name: file.Name, MimeType: file.MimeType, Data: file.Data})
+	}
+
 	err = email.Send(smtpClient)
 	if err != nil {
 		log.Println("Email: error sending email")
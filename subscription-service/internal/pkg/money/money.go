@@ -0,0 +1,234 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrCurrencyMismatch is returned when combining amounts in different currencies
+	ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+	// ErrInvalidAmount is returned for amounts that are not decimals with at most the currency's minor unit digits
+	ErrInvalidAmount = errors.New("invalid monetary amount")
+)
+
+// exponents holds the number of minor unit digits of currencies that do not use cents
+var exponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+// Money is an exact amount in the minor unit of its currency, e.g. 1999 EUR is 19.99 EUR.
+//
+// Rounding rules: amounts read from JSON or the database are never rounded; a value with more
+// decimals than the currency allows is rejected. Amounts derived by MulRatio are rounded half away
+// from zero to the minor unit. Allocate splits an amount into parts that always sum to the original.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// Exponent returns the number of minor unit digits of the ISO 4217 currency code
+func Exponent(currency string) int {
+	if exp, ok := exponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// ValidCurrency reports whether code has the form of an ISO 4217 currency code, three upper case letters
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// New returns an amount of minor units in the given currency
+func New(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: strings.ToUpper(currency)}
+}
+
+// Zero returns no money in the given currency
+func Zero(currency string) Money {
+	return New(0, currency)
+}
+
+// Parse reads a decimal amount such as "199", "8.3" or "-12.50" in the given currency
+func Parse(amount string, currency string) (Money, error) {
+	exp := Exponent(currency)
+
+	s := strings.TrimSpace(amount)
+	negative := strings.HasPrefix(s, "-")
+	if negative || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	if !digits(whole) || fraction != "" && !digits(fraction) ||
+		len(fraction) > exp && strings.TrimRight(fraction[exp:], "0") != "" {
+		return Money{}, fmt.Errorf("%w: %q in %s", ErrInvalidAmount, amount, currency)
+	}
+	if len(fraction) > exp {
+		fraction = fraction[:exp]
+	}
+	fraction += strings.Repeat("0", exp-len(fraction))
+
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q in %s", ErrInvalidAmount, amount, currency)
+	}
+	if negative {
+		minor = -minor
+	}
+
+	return New(minor, currency), nil
+}
+
+// digits reports whether s is a non-empty string of ASCII digits
+func digits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount as a decimal with the currency's minor unit digits, without the currency
+func (m Money) String() string {
+	exp := Exponent(m.Currency)
+
+	sign := ""
+	minor := m.Amount
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+
+	digits := strconv.FormatInt(minor, 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Neg returns the amount with the opposite sign
+func (m Money) Neg() Money {
+	return New(-m.Amount, m.Currency)
+}
+
+// Add returns the sum of two amounts in the same currency
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return New(m.Amount+o.Amount, m.Currency), nil
+}
+
+// Sub returns the difference of two amounts in the same currency
+func (m Money) Sub(o Money) (Money, error) {
+	return m.Add(o.Neg())
+}
+
+// MulRatio returns the amount multiplied by num/den, rounded half away from zero to the minor unit
+func (m Money) MulRatio(num, den int64) Money {
+	if den < 0 {
+		num, den = -num, -den
+	}
+
+	product := m.Amount * num
+	quotient, remainder := product/den, product%den
+	if remainder < 0 {
+		remainder = -remainder
+	}
+	if 2*remainder >= den {
+		if product < 0 {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+
+	return New(quotient, m.Currency)
+}
+
+// Allocate splits the amount into n parts that sum exactly to it. Parts differ by at most one minor
+// unit and the larger parts come first, so 100.00 in 3 parts is 33.34, 33.33 and 33.33.
+func (m Money) Allocate(n int) []Money {
+	if n <= 0 {
+		return nil
+	}
+
+	share, remainder := m.Amount/int64(n), m.Amount%int64(n)
+	step := int64(1)
+	if remainder < 0 {
+		step, remainder = -1, -remainder
+	}
+
+	parts := make([]Money, n)
+	for i := range parts {
+		parts[i] = New(share, m.Currency)
+		if int64(i) < remainder {
+			parts[i].Amount += step
+		}
+	}
+
+	return parts
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"Amount"`
+	Currency string          `json:"Currency"`
+}
+
+// MarshalJSON encodes the amount as a decimal string, e.g. {"Amount":"8.34","Currency":"EUR"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"Amount"`
+		Currency string `json:"Currency"`
+	}{m.String(), m.Currency})
+}
+
+// UnmarshalJSON accepts the amount as a decimal string or a JSON number
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw moneyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Currency == "" {
+		return fmt.Errorf("%w: missing currency", ErrInvalidAmount)
+	}
+
+	amount := string(bytes.Trim(raw.Amount, `"`))
+	parsed, err := Parse(amount, raw.Currency)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,165 @@
+package money
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{"199", "EUR", New(19900, "EUR"), false},
+		{"8.3", "eur", New(830, "EUR"), false},
+		{"-12.50", "EUR", New(-1250, "EUR"), false},
+		{"+0.01", "USD", New(1, "USD"), false},
+		{"12.500", "EUR", New(1250, "EUR"), false},
+		{" 7.05 ", "EUR", New(705, "EUR"), false},
+		{"1500", "JPY", New(1500, "JPY"), false},
+		{"1.250", "BHD", New(1250, "BHD"), false},
+		{"0.005", "KWD", New(5, "KWD"), false},
+		{"12.505", "EUR", Money{}, true},
+		{"1.5", "JPY", Money{}, true},
+		{"1.2505", "BHD", Money{}, true},
+		{".50", "EUR", Money{}, true},
+		{"", "EUR", Money{}, true},
+		{"12,50", "EUR", Money{}, true},
+		{"abc", "EUR", Money{}, true},
+		{"--5", "EUR", Money{}, true},
+		{"+-5", "EUR", Money{}, true},
+		{"-+5", "EUR", Money{}, true},
+		{"5.-1", "EUR", Money{}, true},
+		{"-", "EUR", Money{}, true},
+		{"1.", "EUR", New(100, "EUR"), false},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.amount, tt.currency)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidAmount) {
+				t.Errorf("Parse(%q, %s) error = %v, want ErrInvalidAmount", tt.amount, tt.currency, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q, %s) = %v, %v, want %v", tt.amount, tt.currency, got, err, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{New(1999, "EUR"), "19.99"},
+		{New(5, "EUR"), "0.05"},
+		{New(-5, "EUR"), "-0.05"},
+		{New(1500, "JPY"), "1500"},
+		{New(1250, "BHD"), "1.250"},
+		{New(5, "KWD"), "0.005"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.money, got, tt.want)
+		}
+	}
+}
+
+func TestMulRatio(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		num, den int64
+		want     int64
+	}{
+		{1000, 1, 3, 333},
+		{1000, 2, 3, 667},
+		{1, 1, 2, 1},
+		{-1, 1, 2, -1},
+		{5, 1, 2, 3},
+		{-5, 1, 2, -3},
+		{5, -1, 2, -3},
+		{5, 1, -2, -3},
+		{3, 1, 4, 1},
+		{-3, 1, 4, -1},
+		{2999, 15, 31, 1451},
+		{1999, 0, 31, 0},
+	}
+
+	for _, tt := range tests {
+		if got := New(tt.amount, "EUR").MulRatio(tt.num, tt.den); got.Amount != tt.want {
+			t.Errorf("MulRatio(%d, %d/%d) = %d, want %d", tt.amount, tt.num, tt.den, got.Amount, tt.want)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		amount int64
+		n      int
+		want   []int64
+	}{
+		{10000, 3, []int64{3334, 3333, 3333}},
+		{101, 4, []int64{26, 25, 25, 25}},
+		{-10000, 3, []int64{-3334, -3333, -3333}},
+		{2, 3, []int64{1, 1, 0}},
+		{900, 3, []int64{300, 300, 300}},
+		{500, 1, []int64{500}},
+		{500, 0, nil},
+	}
+
+	for _, tt := range tests {
+		parts := New(tt.amount, "EUR").Allocate(tt.n)
+		if len(parts) != len(tt.want) {
+			t.Errorf("Allocate(%d, %d) returned %d parts, want %d", tt.amount, tt.n, len(parts), len(tt.want))
+			continue
+		}
+		for i, part := range parts {
+			if part.Amount != tt.want[i] || part.Currency != "EUR" {
+				t.Errorf("Allocate(%d, %d)[%d] = %v, want %d EUR", tt.amount, tt.n, i, part, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAddCurrencyMismatch(t *testing.T) {
+	if _, err := New(100, "EUR").Add(New(100, "USD")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Add error = %v, want ErrCurrencyMismatch", err)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    Percent
+		wantErr bool
+	}{
+		{"19", 1900, false},
+		{"5.5", 550, false},
+		{" 25.50 ", 2550, false},
+		{"7.000", 700, false},
+		{"7.005", 0, true},
+		{"-5", 0, true},
+		{"+5", 0, true},
+		{"--5", 0, true},
+		{"5.-1", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePercent(tt.rate)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidAmount) {
+				t.Errorf("ParsePercent(%q) = %v, %v, want ErrInvalidAmount", tt.rate, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePercent(%q) = %v, %v, want %v", tt.rate, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Percent is a rate in hundredths of a percent, so 19% is 1900 and 5.5% is 550.
+type Percent int64
+
+// ParsePercent reads a decimal percentage such as "19", "5.5" or "25.50"
+func ParsePercent(rate string) (Percent, error) {
+	whole, fraction, _ := strings.Cut(strings.TrimSpace(rate), ".")
+	if !digits(whole) || fraction != "" && !digits(fraction) || len(fraction) > 2 && strings.TrimRight(fraction[2:], "0") != "" {
+		return 0, fmt.Errorf("%w: %q is not a percentage", ErrInvalidAmount, rate)
+	}
+	if len(fraction) > 2 {
+		fraction = fraction[:2]
+	}
+	fraction += strings.Repeat("0", 2-len(fraction))
+
+	hundredths, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q is not a percentage", ErrInvalidAmount, rate)
+	}
+
+	return Percent(hundredths), nil
+}
+
+// String formats the rate with two decimals, e.g. "19.00"
+func (p Percent) String() string {
+	return fmt.Sprintf("%d.%02d", p/100, p%100)
+}
+
+// Of returns the rate applied to the amount, rounded half away from zero to the minor unit
+func (p Percent) Of(m Money) Money {
+	return m.MulRatio(int64(p), 10000)
+}
+
+// MarshalJSON encodes the rate as a decimal string
+func (p Percent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON accepts the rate as a decimal string or a JSON number
+func (p *Percent) UnmarshalJSON(data []byte) error {
+	parsed, err := ParsePercent(string(bytes.Trim(data, `"`)))
+	if err != nil {
+		return err
+	}
+
+	*p = parsed
+	return nil
+}
@@ -1,213 +1,567 @@
 package scheduler
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"subscription-service/internal/constants/models"
 	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/billing"
 	"subscription-service/internal/pkg/httpclient"
-	ig "subscription-service/internal/pkg/invoicegenerator"
+	"subscription-service/internal/pkg/lifecycle"
 	"subscription-service/internal/pkg/mailer"
+	"subscription-service/internal/pkg/workerpool"
 	"subscription-service/internal/storage/db"
+	"sync"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/robfig/cron/v3"
 )
 
+// Advisory lock keys guarding the scheduled jobs, so that only one replica runs each job at a time
+const (
+	billingLockKey       int64 = 4711001
+	resendLockKey        int64 = 4711002
+	trialReminderLockKey int64 = 4711003
+)
+
+// ErrRunInProgress is returned when another instance currently holds the job's lock
+var ErrRunInProgress = errors.New("another instance is already running this job")
+
 type SchedulerService struct {
 	cron                    *cron.Cron
-	Rabbit                  *amqp.Connection
 	subscriptionPersistence db.SubscriptionPersistence
 	planPersistence         db.PlanPersistence
 	userPersistence         db.UserPersistence
 	invoicePersistence      db.InvoicePersistence
-	invoicegenerator        ig.InvoiceGenerator
+	billingRunPersistence   db.BillingRunPersistence
+	lockPersistence         db.LockPersistence
+	invoiceService          billing.InvoiceService
+	lifecycleService        lifecycle.Service
 	mail                    mailer.Mail
+	workers                 int
+	// trialReminderDays is how many days before the end of a free trial the customer is reminded of the first charge
+	trialReminderDays int
 }
 
-func NewSchedulerService(cron *cron.Cron, Rabbit *amqp.Connection,
+func NewSchedulerService(cron *cron.Cron,
 	subscriptionPersistence db.SubscriptionPersistence,
 	planPersistence db.PlanPersistence,
 	userPersistence db.UserPersistence,
 	invoicePersistence db.InvoicePersistence,
-	invoicegenerator ig.InvoiceGenerator,
+	billingRunPersistence db.BillingRunPersistence,
+	lockPersistence db.LockPersistence,
+	invoiceService billing.InvoiceService,
+	lifecycleService lifecycle.Service,
 	mail mailer.Mail,
+	workers int,
+	trialReminderDays int,
 ) SchedulerService {
 	return SchedulerService{
 		cron:                    cron,
-		Rabbit:                  Rabbit,
 		subscriptionPersistence: subscriptionPersistence,
 		planPersistence:         planPersistence,
 		userPersistence:         userPersistence,
 		invoicePersistence:      invoicePersistence,
-		invoicegenerator:        invoicegenerator,
+		billingRunPersistence:   billingRunPersistence,
+		lockPersistence:         lockPersistence,
+		invoiceService:          invoiceService,
+		lifecycleService:        lifecycleService,
 		mail:                    mail,
+		workers:                 workers,
+		trialReminderDays:       trialReminderDays,
 	}
 }
 
+// Schedules registers the billing jobs and runs the cron scheduler. Every replica runs the same
+// schedule and the jobs coordinate through Postgres advisory locks. Billing runs hourly rather than
+// daily: runs are idempotent and catch up on missed periods, so if the instance holding the lock
+// dies another replica finishes its work on the next tick.
 func (s *SchedulerService) Schedules(wait chan bool) {
-	_, err := s.cron.AddFunc("@daily", s.SendInvoices)
+	_, err := s.cron.AddFunc("@hourly", s.SendInvoices)
 	if err != nil {
-		log.Printf("Error: scheduling daily invoice processing %v", err.Error())
+		log.Printf("Error: scheduling invoice processing %v", err.Error())
 		return
 	}
-	_, err = s.cron.AddFunc("@daily", s.ReSendFailedInvoices)
+	_, err = s.cron.AddFunc("@every 5m", s.ReSendFailedInvoices)
 	if err != nil {
 		log.Printf("Error: scheduling failed invoice processing %v", err.Error())
 		return
 	}
+	_, err = s.cron.AddFunc("@daily", s.SendTrialReminders)
+	if err != nil {
+		log.Printf("Error: scheduling trial reminders %v", err.Error())
+		return
+	}
 	log.Println("************** Crone Job Started *****************")
 	s.cron.Run()
 }
 
+// billingOutcome is how a single subscription fared during a billing run
+type billingOutcome int
+
+const (
+	outcomeBilled billingOutcome = iota
+	outcomeSkipped
+	outcomeFailed
+)
+
+// SendInvoices bills every subscription that is due today, catching up on periods that were
+// missed while the service was not running.
 func (s *SchedulerService) SendInvoices() {
-	log.Println("Resending Invoice Started")
-	subscriptions, err := s.subscriptionPersistence.GetSubscriptionsToBillToday()
+	today, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
+	if _, err := s.RunBilling(time.Time{}, today, states.BILLING_RUN_SCHEDULED); err != nil {
+		log.Printf("Skipping billing run: %v", err.Error())
+	}
+}
+
+// RunBilling invoices the subscriptions whose next billing date falls between the from and to dates,
+// both inclusive. A subscription that missed several periods gets one invoice per missed period, and
+// the charges of one user's subscriptions that fall on the same day are consolidated into one invoice.
+// Periods that already have an invoice are skipped, so running the same range twice is a no-op.
+// The returned run reports how many subscriptions were billed, skipped or failed. Only one
+// instance bills at a time; ErrRunInProgress is returned while another run holds the lock.
+func (s *SchedulerService) RunBilling(from, to time.Time, trigger string) (models.BillingRun, error) {
+	release, acquired, err := s.lockPersistence.TryLock(billingLockKey)
+	if err != nil {
+		return models.BillingRun{}, err
+	}
+	if !acquired {
+		return models.BillingRun{}, ErrRunInProgress
+	}
+	defer release()
+
+	log.Printf("Billing run started for %s - %s", from.Format(states.TIME_LAYOUT), to.Format(states.TIME_LAYOUT))
+	run := s.startRun(states.BILLING_JOB_BILLING, trigger, from, to)
+
+	until := to.AddDate(0, 0, 1)
+	subscriptions, err := s.subscriptionPersistence.GetSubscriptionsDue(from, until)
 	if err != nil {
 		log.Printf("Error: fetching subscription %v", err.Error())
-		return
+		run.Status = states.BILLING_RUN_FAILED
+		s.finishRun(run)
+		return run, nil
 	}
+
+	var mu sync.Mutex
+	workerpool.Run(s.workers, byUser(subscriptions), func(subscriptions []*models.Subscription) {
+		outcomes := s.billUser(subscriptions, until, run.ID)
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, outcome := range outcomes {
+			tally(&run, outcome)
+		}
+	})
+
+	run.Status = states.BILLING_RUN_COMPLETED
+	s.finishRun(run)
+	return run, nil
+}
+
+func (s *SchedulerService) startRun(job, trigger string, from, to time.Time) models.BillingRun {
+	run := models.BillingRun{
+		Job:        job,
+		Trigger:    trigger,
+		PeriodFrom: from,
+		PeriodTo:   to,
+		Status:     states.BILLING_RUN_RUNNING,
+		StartedAt:  time.Now(),
+	}
+
+	runID, err := s.billingRunPersistence.StartRun(run)
+	if err != nil {
+		log.Printf("Error: recording billing run %v", err.Error())
+	}
+	run.ID = runID
+
+	return run
+}
+
+// tally adds the outcome of one subscription or invoice to the run counters
+func tally(run *models.BillingRun, outcome billingOutcome) {
+	switch outcome {
+	case outcomeBilled:
+		run.Billed++
+	case outcomeSkipped:
+		run.Skipped++
+	default:
+		run.Failed++
+	}
+}
+
+func (s *SchedulerService) finishRun(run models.BillingRun) {
+	run.FinishedAt = time.Now()
+	if err := s.billingRunPersistence.FinishRun(run); err != nil {
+		log.Printf("Error: recording billing run %v", err.Error())
+	}
+	log.Printf("%s run %d %s: %d billed, %d skipped, %d failed", run.Job, run.ID, run.Status, run.Billed, run.Skipped, run.Failed)
+}
+
+// byUser groups the subscriptions by user, keeping their order
+func byUser(subscriptions []*models.Subscription) [][]*models.Subscription {
+	var groups [][]*models.Subscription
+	index := map[int]int{}
+
 	for _, subscription := range subscriptions {
-		go func(subscription *models.Subscription) {
-			plan, err := s.planPersistence.GetPlanByID(subscription.PlanID)
-			if err != nil {
-				log.Printf("Error: fetching plan %v", err.Error())
-				return
-			}
-			user, err := s.userPersistence.GetOne(subscription.UserID)
-			if err != nil {
-				log.Printf("Error: fetching user %v", err.Error())
-				return
-			}
-			addr, err := s.userPersistence.GetBillingAddressByUserID(subscription.UserID)
+		i, ok := index[subscription.UserID]
+		if !ok {
+			i = len(groups)
+			index[subscription.UserID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], subscription)
+	}
+
+	return groups
+}
+
+// prepare brings a due subscription into the state it is billed in: paused subscriptions whose pause
+// has ended are resumed, trialing ones are activated, and subscriptions set to cancel at period end
+// are canceled instead. It returns nil with the outcome when there is nothing to bill.
+func (s *SchedulerService) prepare(subscription *models.Subscription) (*models.Subscription, billingOutcome) {
+	if subscription.Status == states.PAUSED {
+		resumed, err := s.lifecycleService.Resume(*subscription, 0)
+		if err != nil {
+			log.Printf("Error: resuming subscription %v", err.Error())
+			return nil, outcomeFailed
+		}
+		subscription = &resumed
+	}
+
+	if subscription.CancelAtPeriodEnd {
+		if _, err := s.lifecycleService.Cancel(*subscription, false, 0); err != nil {
+			log.Printf("Error: canceling subscription %v", err.Error())
+			return nil, outcomeFailed
+		}
+		return nil, outcomeSkipped
+	}
+
+	if subscription.Status == states.TRIALING {
+		activated, err := s.lifecycleService.EndTrial(*subscription, 0)
+		if err != nil {
+			log.Printf("Error: ending trial %v", err.Error())
+			return nil, outcomeFailed
+		}
+		subscription = &activated
+	}
+
+	return subscription, outcomeSkipped
+}
+
+// billUser issues the invoices for every period that starts before until of the user's subscriptions,
+// one invoice per billing day and currency, and returns the outcome of each subscription.
+func (s *SchedulerService) billUser(subscriptions []*models.Subscription, until time.Time, billingRunID int) []billingOutcome {
+	outcomes := make(map[int]billingOutcome, len(subscriptions))
+	plans := make(map[int]*models.Plan, len(subscriptions))
+	var pending []*models.Subscription
+
+	for _, subscription := range subscriptions {
+		prepared, outcome := s.prepare(subscription)
+		outcomes[subscription.ID] = outcome
+		if prepared == nil {
+			continue
+		}
+
+		plan, err := s.planPersistence.GetPlanByID(prepared.PlanID)
+		if err != nil {
+			log.Printf("Error: fetching plan %v", err.Error())
+			outcomes[subscription.ID] = outcomeFailed
+			continue
+		}
+		plans[prepared.ID] = plan
+		pending = append(pending, prepared)
+	}
+
+	if len(pending) > 0 {
+		s.billCharges(pending, plans, outcomes, until, billingRunID)
+	}
+
+	result := make([]billingOutcome, 0, len(outcomes))
+	for _, outcome := range outcomes {
+		result = append(result, outcome)
+	}
+	return result
+}
+
+// billCharges invoices the pending subscriptions of one user day by day, recording each
+// subscription's outcome, until none of them has a period starting before until
+func (s *SchedulerService) billCharges(pending []*models.Subscription, plans map[int]*models.Plan, outcomes map[int]billingOutcome, until time.Time, billingRunID int) {
+	fail := func(subscriptions []*models.Subscription) {
+		for _, subscription := range subscriptions {
+			outcomes[subscription.ID] = outcomeFailed
+		}
+	}
+
+	user, err := s.userPersistence.GetOne(pending[0].UserID)
+	if err != nil {
+		log.Printf("Error: fetching user %v", err.Error())
+		fail(pending)
+		return
+	}
+	addr, err := s.userPersistence.GetBillingAddressByUserID(pending[0].UserID)
+	if err != nil {
+		log.Printf("Error: fetching subscription %v", err.Error())
+		fail(pending)
+		return
+	}
+
+	for {
+		group, rest := nextCharges(pending, until)
+		if len(group) == 0 {
+			return
+		}
+
+		charges := make([]billing.Charge, len(group))
+		for i, subscription := range group {
+			charges[i] = billing.Charge{Subscription: *subscription, Plan: *plans[subscription.ID]}
+		}
+
+		invoice, err := s.invoiceService.IssueConsolidated(*user, *addr, charges, billingRunID)
+		if errors.Is(err, db.ErrSubscriptionAlreadyBilled) {
+			log.Printf("subscriptions of user %d already invoiced for %s", user.ID, group[0].NextBillingDate.Format(states.TIME_LAYOUT))
+			pending = rest
+			continue
+		}
+		if invoice == nil {
+			log.Printf("Error: recording invoice %v", err.Error())
+			fail(group)
+			pending = rest
+			continue
+		}
+
+		// invoices that could not be delivered are queued for a resend by the invoice service
+		if err == nil {
+			httpclient.PostInvoiceToAccountingService(invoice.InvoiceNumber)
+		}
+
+		// reload to pick up the billed cycles and next billing date advanced by the invoice
+		pending = rest
+		for _, subscription := range group {
+			outcomes[subscription.ID] = outcomeBilled
+
+			reloaded, err := s.subscriptionPersistence.GetOne(subscription.ID)
 			if err != nil {
 				log.Printf("Error: fetching subscription %v", err.Error())
-				return
+				outcomes[subscription.ID] = outcomeFailed
+				continue
 			}
+			pending = append(pending, reloaded)
+		}
+	}
+}
 
-			invoiceID, err := sendInvoice(models.InvoicePayload{
-				User:           *user,
-				BillingAddress: *addr,
-				Subscription:   *subscription,
-				Plan:           *plan,
-			}, "", s.invoicegenerator, s.mail)
-			if err != nil {
-				log.Printf("Error: sending invocie %v", err.Error())
-				s.invoicePersistence.AddFailedInvoice(models.FailedInvoice{
-					SubscriptionID: subscription.ID,
-					InvoiceID:      invoiceID,
-					InvoiceDate:    time.Now(),
-					EmailRetry:     1,
-				})
-				return
-			}
-			httpclient.PostInvoiceToAccountingService(invoiceID)
+// nextCharges picks the billable subscriptions whose next billing date falls on the earliest billing
+// day before until and share the currency of the first of them, and returns them with the others
+func nextCharges(pending []*models.Subscription, until time.Time) (group, rest []*models.Subscription) {
+	var first *models.Subscription
+	for _, subscription := range pending {
+		if billable(subscription, until) && (first == nil || subscription.NextBillingDate.Before(first.NextBillingDate)) {
+			first = subscription
+		}
+	}
+	if first == nil {
+		return nil, pending
+	}
 
-		}(subscription)
+	day := first.NextBillingDate.Format(states.TIME_LAYOUT)
+	for _, subscription := range pending {
+		if billable(subscription, until) &&
+			subscription.NextBillingDate.Format(states.TIME_LAYOUT) == day &&
+			subscription.Price.Currency == first.Price.Currency {
+			group = append(group, subscription)
+		} else {
+			rest = append(rest, subscription)
+		}
 	}
+
+	return group, rest
+}
+
+// billable reports whether the subscription has a cycle left that starts before until
+func billable(subscription *models.Subscription, until time.Time) bool {
+	return subscription.Status == states.ACTIVE &&
+		subscription.BilledCycles < int(subscription.BillingFrequency) &&
+		subscription.NextBillingDate.Before(until)
 }
 
+// ReSendFailedInvoices retries delivering the invoices whose email could not be sent and whose next
+// attempt is due. It runs every few minutes so that the backoff between attempts is kept; a run
+// is only recorded if an invoice was due. Like billing, it only runs on the instance holding its
+// advisory lock.
 func (s *SchedulerService) ReSendFailedInvoices() {
-	log.Println("Resending Unsent Invoices Started")
+	release, acquired, err := s.lockPersistence.TryLock(resendLockKey)
+	if err != nil {
+		log.Printf("Error: acquiring resend lock %v", err.Error())
+		return
+	}
+	if !acquired {
+		log.Printf("Skipping failed invoice resend: %v", ErrRunInProgress)
+		return
+	}
+	defer release()
 
-	failedInvoices, err := s.invoicePersistence.GetAllFailedInvoices()
+	today, _ := time.Parse(states.TIME_LAYOUT, time.Now().Format(states.TIME_LAYOUT))
+	failedInvoices, err := s.invoicePersistence.GetDueFailedInvoices(time.Now())
 	if err != nil {
 		log.Printf("Error: fetching failed invoices %v", err.Error())
+		run := s.startRun(states.BILLING_JOB_RESEND, states.BILLING_RUN_SCHEDULED, today, today)
+		run.Status = states.BILLING_RUN_FAILED
+		s.finishRun(run)
+		return
+	}
+	if len(failedInvoices) == 0 {
 		return
 	}
-	for _, invoice := range failedInvoices {
-		go func(invoice models.FailedInvoice) {
-			subscription, err := s.subscriptionPersistence.GetOne(invoice.SubscriptionID)
-			if err != nil {
-				log.Printf("Error: fetching plan %v", err.Error())
-				return
-			}
-			plan, err := s.planPersistence.GetPlanByID(subscription.PlanID)
-			if err != nil {
-				log.Printf("Error: fetching plan %v", err.Error())
-				return
-			}
-			user, err := s.userPersistence.GetOne(subscription.UserID)
-			if err != nil {
-				log.Printf("Error: fetching user %v", err.Error())
-				return
-			}
-			addr, err := s.userPersistence.GetBillingAddressByUserID(subscription.UserID)
-			if err != nil {
-				log.Printf("Error: fetching subscription %v", err.Error())
-				return
-			}
 
-			invoiceID, err := sendInvoice(models.InvoicePayload{
-				User:           *user,
-				BillingAddress: *addr,
-				Subscription:   *subscription,
-				Plan:           *plan,
-			}, invoice.InvoiceID, s.invoicegenerator, s.mail)
-			if err != nil {
-				log.Printf("Error: re-sending invocie %v", err.Error())
-				s.invoicePersistence.UpdateInvoice(invoiceID, invoice.EmailRetry+1)
-				return
-			} else {
-				s.invoicePersistence.DeleteInvoice(invoiceID)
-				httpclient.PostInvoiceToAccountingService(invoiceID)
-			}
-		}(invoice)
-	}
-}
-
-func sendInvoice(invoicePld models.InvoicePayload, invoiceID string, invoicegenerator ig.InvoiceGenerator, mail mailer.Mail) (string, error) {
-	if invoiceID == "" {
-		// Generate an Invoice
-		invoiceItem := models.InvoiceItem{
-			Name:        fmt.Sprintf("%s %s", invoicePld.Subscription.ProductCode, invoicePld.Plan.Name),
-			Description: "",
-			UnitCost:    fmt.Sprint(invoicePld.Subscription.Price / float32(invoicePld.Subscription.BillingFrequency)),
-			Quantity:    "1",
-			Tax:         "0",
-			Discount:    "0",
-		}
-
-		invoice := models.Invoice{
-			Date:         time.Now().Format(states.TIME_LAYOUT),
-			PaymentTerm:  time.Now().Add(time.Hour * 24 * 7).Format(states.TIME_LAYOUT),
-			CustomerName: fmt.Sprintf("%s %s", invoicePld.User.FirstName, invoicePld.User.LastName),
-			Description:  "Invoice Description",
-			Notes:        "",
-			CustomerAddress: models.Address{
-				Address:    invoicePld.BillingAddress.Address,
-				Address2:   invoicePld.BillingAddress.Address2,
-				PostalCode: invoicePld.BillingAddress.PostalCode,
-				City:       invoicePld.BillingAddress.City,
-				Country:    invoicePld.BillingAddress.Country,
-			},
-			Items: []models.InvoiceItem{invoiceItem},
-		}
-		id, err := invoicegenerator.Generate(invoice)
-		if err != nil {
-			log.Println("Error: generate invoice")
-			log.Println(err)
-			return "", err
-		}
-		invoiceID = id
+	log.Println("Resending Unsent Invoices Started")
+	run := s.startRun(states.BILLING_JOB_RESEND, states.BILLING_RUN_SCHEDULED, today, today)
+
+	var mu sync.Mutex
+	workerpool.Run(s.workers, failedInvoices, func(invoice models.FailedInvoice) {
+		outcome := s.resendInvoice(invoice)
+
+		mu.Lock()
+		defer mu.Unlock()
+		tally(&run, outcome)
+	})
+
+	run.Status = states.BILLING_RUN_COMPLETED
+	s.finishRun(run)
+}
+
+// ResendFailedInvoice retries delivering the failed invoice with the given ID right away, whether its
+// next attempt is due or it was given up as undeliverable. It returns the failed invoice, updated
+// like by the resend job if the attempt failed. ErrRunInProgress is returned while the resend job
+// holds the lock, so that an invoice is never sent twice at once.
+func (s *SchedulerService) ResendFailedInvoice(id int) (models.FailedInvoice, error) {
+	release, acquired, err := s.lockPersistence.TryLock(resendLockKey)
+	if err != nil {
+		return models.FailedInvoice{}, err
 	}
+	if !acquired {
+		return models.FailedInvoice{}, ErrRunInProgress
+	}
+	defer release()
 
-	// Send Email
-	invoicePDF := fmt.Sprintf("../../../temp/%s.pdf", invoiceID)
-	log.Printf("Mail: %+v", mail)
+	invoice, err := s.invoicePersistence.GetFailedInvoiceByID(id)
+	if err != nil {
+		return models.FailedInvoice{}, err
+	}
+
+	return s.retryInvoice(invoice)
+}
 
-	err := mail.SendSMTPMessage(mailer.Message{
-		To:          invoicePld.User.Email,
-		Subject:     "Invoice For Movido Subscription",
-		Attachments: []string{invoicePDF},
-		Data:        "Invoice",
-		DataMap:     map[string]any{"inv": "Invoice"},
+// resendInvoice retries delivering one failed invoice
+func (s *SchedulerService) resendInvoice(invoice models.FailedInvoice) billingOutcome {
+	if _, err := s.retryInvoice(invoice); err != nil {
+		return outcomeFailed
+	}
+	return outcomeBilled
+}
+
+// retryInvoice redelivers the failed invoice. On success it is removed from the failed invoices and
+// reported to accounting, otherwise the next attempt is scheduled.
+func (s *SchedulerService) retryInvoice(invoice models.FailedInvoice) (models.FailedInvoice, error) {
+	if err := s.redeliver(invoice); err != nil {
+		log.Printf("Error: re-sending invocie %v", err.Error())
+		return s.invoiceService.DeliveryFailed(invoice, err), err
+	}
+
+	s.invoicePersistence.DeleteInvoice(invoice.InvoiceID)
+	httpclient.PostInvoiceToAccountingService(invoice.InvoiceID)
+	return invoice, nil
+}
+
+// redeliver emails the failed invoice to the subscription's user
+func (s *SchedulerService) redeliver(invoice models.FailedInvoice) error {
+	subscription, err := s.subscriptionPersistence.GetOne(invoice.SubscriptionID)
+	if err != nil {
+		log.Printf("Error: fetching plan %v", err.Error())
+		return err
+	}
+	plan, err := s.planPersistence.GetPlanByID(subscription.PlanID)
+	if err != nil {
+		log.Printf("Error: fetching plan %v", err.Error())
+		return err
+	}
+	user, err := s.userPersistence.GetOne(subscription.UserID)
+	if err != nil {
+		log.Printf("Error: fetching user %v", err.Error())
+		return err
+	}
+	addr, err := s.userPersistence.GetBillingAddressByUserID(subscription.UserID)
+	if err != nil {
+		log.Printf("Error: fetching subscription %v", err.Error())
+		return err
+	}
+
+	record, err := s.invoicePersistence.GetInvoiceByNumber(invoice.InvoiceID)
+	if err != nil {
+		log.Printf("Error: fetching invoice %v", err.Error())
+		return err
+	}
+
+	return s.invoiceService.Deliver(record, models.InvoicePayload{
+		User:           *user,
+		BillingAddress: *addr,
+		Subscription:   *subscription,
+		Plan:           *plan,
+	})
+}
+
+// SendTrialReminders emails the customers whose free trial ends within trialReminderDays about
+// their first charge. Each subscription is reminded once.
+func (s *SchedulerService) SendTrialReminders() {
+	release, acquired, err := s.lockPersistence.TryLock(trialReminderLockKey)
+	if err != nil {
+		log.Printf("Error: acquiring trial reminder lock %v", err.Error())
+		return
+	}
+	if !acquired {
+		log.Printf("Skipping trial reminders: %v", ErrRunInProgress)
+		return
+	}
+	defer release()
+
+	until := time.Now().AddDate(0, 0, s.trialReminderDays)
+	subscriptions, err := s.subscriptionPersistence.GetTrialsEndingBefore(until)
+	if err != nil {
+		log.Printf("Error: fetching trialing subscriptions %v", err.Error())
+		return
+	}
+
+	workerpool.Run(s.workers, subscriptions, s.sendTrialReminder)
+}
+
+// sendTrialReminder tells the customer when their trial ends and what the first invoice will charge
+func (s *SchedulerService) sendTrialReminder(subscription *models.Subscription) {
+	plan, err := s.planPersistence.GetPlanByID(subscription.PlanID)
+	if err != nil {
+		log.Printf("Error: fetching plan %v", err.Error())
+		return
+	}
+	user, err := s.userPersistence.GetOne(subscription.UserID)
+	if err != nil {
+		log.Printf("Error: fetching user %v", err.Error())
+		return
+	}
+
+	firstCharge := billing.CycleAmount(*subscription, 0)
+	trialEnd := subscription.NextBillingDate.Format(states.TIME_LAYOUT)
+
+	err = s.mail.SendSMTPMessage(mailer.Message{
+		To:      user.Email,
+		Subject: fmt.Sprintf("Your %s trial ends on %s", plan.Name, trialEnd),
+		Data: fmt.Sprintf("Your free trial of %s ends on %s. Your first invoice of %s %s plus applicable VAT will be issued on that day.",
+			plan.Name, trialEnd, firstCharge, firstCharge.Currency),
 	})
 	if err != nil {
-		log.Println("Error: sending main")
-		log.Println(err)
-		return invoiceID, err
+		log.Printf("Error: sending trial reminder %v", err.Error())
+		return
+	}
+
+	if err := s.subscriptionPersistence.MarkTrialReminderSent(subscription.ID); err != nil {
+		log.Printf("Error: recording trial reminder %v", err.Error())
 	}
-	return invoiceID, nil
 }
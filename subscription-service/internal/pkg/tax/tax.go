@@ -0,0 +1,132 @@
+package tax
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/money"
+)
+
+// ErrUnknownCountry is returned for addresses whose country cannot be mapped to an ISO country code
+var ErrUnknownCountry = errors.New("unknown country")
+
+const (
+	reverseChargeNote = "Reverse charge: VAT to be accounted for by the recipient (Art. 196 Directive 2006/112/EC). Customer VAT ID: %s"
+	exportNote        = "Not subject to VAT: service supplied to a customer outside the EU."
+)
+
+// euCountries is the set of EU member states, by ISO 3166 alpha-2 code
+var euCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true, "DK": true, "EE": true, "ES": true,
+	"FI": true, "FR": true, "GR": true, "HR": true, "HU": true, "IE": true, "IT": true, "LT": true, "LU": true,
+	"LV": true, "MT": true, "NL": true, "PL": true, "PT": true, "RO": true, "SE": true, "SI": true, "SK": true,
+}
+
+// CountryCode maps an address country, given as an ISO code or an English name, to its ISO 3166 alpha-2
+// code. Names are matched regardless of case, spacing, a leading "the" and "&" for "and". It returns
+// ErrUnknownCountry for anything else, including two letters that are not an assigned code.
+func CountryCode(country string) (string, error) {
+	c := strings.TrimSpace(country)
+	if code := strings.ToUpper(c); isoCountries[code] {
+		return code, nil
+	}
+
+	name := strings.Join(strings.Fields(strings.ToLower(c)), " ")
+	name = strings.TrimPrefix(strings.ReplaceAll(name, "&", "and"), "the ")
+	if code, ok := countryNames[name]; ok {
+		return code, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownCountry, country)
+}
+
+// RateSource looks up the VAT rate of a country for a product code, as db.TaxRatePersistence does
+type RateSource interface {
+	GetRate(country, productCode string) (money.Percent, error)
+}
+
+// Determination is the tax treatment of a sale to one customer
+type Determination struct {
+	// Country is the country whose VAT applies, empty when no VAT is charged
+	Country       string
+	Rate          money.Percent
+	ReverseCharge bool
+	// Note is printed on the invoice to explain a zero rate
+	Note string
+}
+
+// Engine determines the VAT on invoices from the company's and the customer's billing address.
+//
+// Sales within the company's country are charged the domestic rate. Sales to other EU countries are
+// charged the customer country's rate, unless the customer is a business with a VAT ID, in which case
+// the reverse charge applies. Sales to customers outside the EU are not subject to EU VAT.
+type Engine struct {
+	taxRatePersistence RateSource
+	companyCountry     string
+}
+
+func NewEngine(taxRatePersistence RateSource, company models.Address) (Engine, error) {
+	companyCountry, err := CountryCode(company.Country)
+	if err != nil {
+		return Engine{}, err
+	}
+
+	return Engine{
+		taxRatePersistence: taxRatePersistence,
+		companyCountry:     companyCountry,
+	}, nil
+}
+
+// Determine returns the tax treatment of the product for the customer's billing address. It returns
+// ErrUnknownCountry if the customer's country is not recognised and db.ErrNoTaxRate if VAT is due in a
+// country without a configured rate, rather than guessing a rate; the invoice is not issued then.
+func (e *Engine) Determine(customer models.Address, productCode string) (Determination, error) {
+	customerCountry, err := CountryCode(customer.Country)
+	if err != nil {
+		return Determination{}, err
+	}
+
+	switch {
+	case customerCountry == e.companyCountry:
+		return e.charge(customerCountry, productCode)
+	case euCountries[e.companyCountry] && euCountries[customerCountry]:
+		if vatID := strings.TrimSpace(customer.VatID); vatID != "" {
+			return Determination{ReverseCharge: true, Note: fmt.Sprintf(reverseChargeNote, vatID)}, nil
+		}
+		return e.charge(customerCountry, productCode)
+	case euCountries[e.companyCountry]:
+		return Determination{Note: exportNote}, nil
+	default:
+		return e.charge(e.companyCountry, productCode)
+	}
+}
+
+func (e *Engine) charge(country, productCode string) (Determination, error) {
+	rate, err := e.taxRatePersistence.GetRate(country, productCode)
+	if err != nil {
+		return Determination{}, fmt.Errorf("tax rate for %s: %w", country, err)
+	}
+
+	return Determination{Country: country, Rate: rate}, nil
+}
+
+// Apply sets the rate and tax amount of every line item and returns the net, tax and gross totals.
+// Tax is computed and rounded per line, and the totals are the sums of the rounded line amounts.
+func Apply(items []models.InvoiceLineItem, determination Determination, currency string) (net, tax, gross money.Money, err error) {
+	net, tax = money.Zero(currency), money.Zero(currency)
+
+	for i := range items {
+		items[i].Tax = determination.Rate
+		items[i].TaxAmount = determination.Rate.Of(items[i].Amount)
+
+		if net, err = net.Add(items[i].Amount); err != nil {
+			return
+		}
+		if tax, err = tax.Add(items[i].TaxAmount); err != nil {
+			return
+		}
+	}
+
+	gross, err = net.Add(tax)
+	return
+}
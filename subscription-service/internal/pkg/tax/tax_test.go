@@ -0,0 +1,203 @@
+package tax
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/money"
+	"subscription-service/internal/storage/db"
+)
+
+// stubRates serves VAT rates by country and product code; an empty product code is the standard rate
+type stubRates map[string]money.Percent
+
+func (s stubRates) GetRate(country, productCode string) (money.Percent, error) {
+	if rate, ok := s[country+"/"+productCode]; ok {
+		return rate, nil
+	}
+	if rate, ok := s[country+"/"]; ok {
+		return rate, nil
+	}
+	return 0, db.ErrNoTaxRate
+}
+
+var rates = stubRates{
+	"DE/":      1900,
+	"DE/BOOKS": 700,
+	"FR/":      2000,
+	"CH/":      810,
+}
+
+func TestCountryCode(t *testing.T) {
+	tests := []struct {
+		country string
+		want    string
+		wantErr bool
+	}{
+		{"DE", "DE", false},
+		{" de ", "DE", false},
+		{"Germany", "DE", false},
+		{"the Netherlands", "NL", false},
+		{"USA", "US", false},
+		{"Japan", "JP", false},
+		{"kenya", "KE", false},
+		{"Bosnia & Herzegovina", "BA", false},
+		{"Korea,  Republic of", "KR", false},
+		{"Côte d'Ivoire", "CI", false},
+		{"EU", "", true},
+		{"XX", "", true},
+		{"Atlantis", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := CountryCode(tt.country)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnknownCountry) {
+				t.Errorf("CountryCode(%q) = %q, %v, want ErrUnknownCountry", tt.country, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("CountryCode(%q) = %q, %v, want %q", tt.country, got, err, tt.want)
+		}
+	}
+}
+
+func TestEveryCodeHasAName(t *testing.T) {
+	named := make(map[string]bool)
+	for _, code := range countryNames {
+		if !isoCountries[code] {
+			t.Errorf("countryNames maps to unassigned code %s", code)
+		}
+		named[code] = true
+	}
+	for code := range isoCountries {
+		if !named[code] {
+			t.Errorf("ISO code %s has no country name", code)
+		}
+	}
+}
+
+func TestDetermine(t *testing.T) {
+	tests := []struct {
+		name     string
+		company  string
+		customer models.Address
+		product  string
+		want     Determination
+		wantNote string
+		wantErr  error
+	}{
+		{
+			name:     "domestic",
+			company:  "Germany",
+			customer: models.Address{Country: "DE"},
+			want:     Determination{Country: "DE", Rate: 1900},
+		},
+		{
+			name:     "domestic reduced rate",
+			company:  "Germany",
+			customer: models.Address{Country: "Germany", VatID: "DE123456789"},
+			product:  "BOOKS",
+			want:     Determination{Country: "DE", Rate: 700},
+		},
+		{
+			name:     "EU consumer pays destination rate",
+			company:  "Germany",
+			customer: models.Address{Country: "France"},
+			want:     Determination{Country: "FR", Rate: 2000},
+		},
+		{
+			name:     "EU business reverse charge",
+			company:  "Germany",
+			customer: models.Address{Country: "FR", VatID: " FR12345678901 "},
+			want:     Determination{ReverseCharge: true},
+			wantNote: "Customer VAT ID: FR12345678901",
+		},
+		{
+			name:     "export outside the EU",
+			company:  "Germany",
+			customer: models.Address{Country: "United States"},
+			want:     Determination{},
+			wantNote: exportNote,
+		},
+		{
+			name:     "export to a country named in full",
+			company:  "Germany",
+			customer: models.Address{Country: "Kenya"},
+			want:     Determination{},
+			wantNote: exportNote,
+		},
+		{
+			name:     "non-EU company charges its own rate",
+			company:  "Switzerland",
+			customer: models.Address{Country: "FR"},
+			want:     Determination{Country: "CH", Rate: 810},
+		},
+		{
+			name:     "EU country without a configured rate",
+			company:  "Germany",
+			customer: models.Address{Country: "IT"},
+			wantErr:  db.ErrNoTaxRate,
+		},
+		{
+			name:     "unknown customer country",
+			company:  "Germany",
+			customer: models.Address{Country: "Atlantis"},
+			wantErr:  ErrUnknownCountry,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := NewEngine(rates, models.Address{Country: tt.company})
+			if err != nil {
+				t.Fatalf("NewEngine: %v", err)
+			}
+
+			got, err := engine.Determine(tt.customer, tt.product)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Determine error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if !strings.Contains(got.Note, tt.wantNote) {
+				t.Errorf("Determine note = %q, want it to contain %q", got.Note, tt.wantNote)
+			}
+			got.Note = ""
+			if got != tt.want {
+				t.Errorf("Determine = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRoundsPerLine(t *testing.T) {
+	items := []models.InvoiceLineItem{
+		{Amount: money.New(3, "EUR")},
+		{Amount: money.New(3, "EUR")},
+		{Amount: money.New(3, "EUR")},
+		{Amount: money.New(-50, "EUR")},
+	}
+
+	net, tax, gross, err := Apply(items, Determination{Country: "DE", Rate: 1900}, "EUR")
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	// 0.03 * 19% = 0.0057 rounds to 0.01 on each line and -0.50 * 19% = -0.095 to -0.10, so the tax
+	// is -0.07; taxing the -0.41 net once would give -0.08
+	for i, want := range []int64{1, 1, 1, -10} {
+		if items[i].Tax != 1900 || items[i].TaxAmount.Amount != want {
+			t.Errorf("item %d tax = %s %d, want 19.00 %d", i, items[i].Tax, items[i].TaxAmount.Amount, want)
+		}
+	}
+	if net.Amount != -41 || tax.Amount != -7 || gross.Amount != -48 {
+		t.Errorf("Apply = %s, %s, %s, want -0.41, -0.07, -0.48", net, tax, gross)
+	}
+}
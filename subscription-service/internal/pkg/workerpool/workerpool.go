@@ -0,0 +1,33 @@
+package workerpool
+
+import "sync"
+
+// Run calls job once for every item using at most workers goroutines, and blocks until
+// every call has returned.
+func Run[T any](workers int, items []T, job func(T)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	jobs := make(chan T)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				job(item)
+			}
+		}()
+	}
+
+	for _, item := range items {
+		jobs <- item
+	}
+	close(jobs)
+
+	wg.Wait()
+}
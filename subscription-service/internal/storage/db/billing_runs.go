@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+)
+
+type BillingRunPersistence struct {
+	db *sql.DB
+}
+
+// NewBillingRunPersistence is the function used to create an instance of the BillingRunPersistence.
+func NewBillingRunPersistence(dbPool *sql.DB) BillingRunPersistence {
+	return BillingRunPersistence{db: dbPool}
+}
+
+// StartRun records a new billing run in the RUNNING state and returns its ID
+func (p *BillingRunPersistence) StartRun(run models.BillingRun) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `INSERT INTO billing_runs (job, trigger, period_from, period_to, status, started_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+	var id int
+	err := p.db.QueryRowContext(ctx, stmt, run.Job, run.Trigger, run.PeriodFrom, run.PeriodTo, states.BILLING_RUN_RUNNING, run.StartedAt).Scan(&id)
+	if err != nil {
+		log.Println("Error inserting billing run:", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// FinishRun stores the final status and counters of a billing run
+func (p *BillingRunPersistence) FinishRun(run models.BillingRun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE billing_runs SET status = $1, billed = $2, skipped = $3, failed = $4, finished_at = $5 WHERE id = $6`
+
+	_, err := p.db.ExecContext(ctx, stmt, run.Status, run.Billed, run.Skipped, run.Failed, run.FinishedAt, run.ID)
+	if err != nil {
+		log.Println("Error updating billing run:", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/money"
+	"time"
+)
+
+var (
+	// ErrCouponUnavailable is returned when redeeming a coupon that is inactive, expired or fully redeemed
+	ErrCouponUnavailable = errors.New("coupon is no longer available")
+	// ErrCouponAlreadyApplied is returned when the subscription has already redeemed a coupon
+	ErrCouponAlreadyApplied = errors.New("a coupon has already been applied to this subscription")
+)
+
+// couponColumns lists the coupon columns in the order scanCoupon reads them
+const couponColumns = `c.id, c.code, c.kind, c.percent, c.amount, c.currency, c.duration, c.duration_cycles,
+        c.max_redemptions, c.times_redeemed, c.expires_at, c.active, c.created_at, c.updated_at`
+
+type CouponPersistence struct {
+	db DBTX
+}
+
+// NewCouponPersistence is the function used to create an instance of the CouponPersistence.
+func NewCouponPersistence(dbPool *sql.DB) CouponPersistence {
+	return CouponPersistence{db: dbPool}
+}
+
+// WithTx returns a CouponPersistence that runs its statements in the unit of work's transaction tx
+func (p *CouponPersistence) WithTx(tx *sql.Tx) CouponPersistence {
+	return CouponPersistence{db: tx}
+}
+
+// GetAllCoupons returns all coupons from the database
+func (p *CouponPersistence) GetAllCoupons() ([]*models.Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, "SELECT "+couponColumns+" FROM coupons c ORDER BY c.id")
+	if err != nil {
+		log.Println("Error querying coupons:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []*models.Coupon
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			log.Println("Error scanning coupon row:", err)
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating through coupons:", err)
+		return nil, err
+	}
+
+	return coupons, nil
+}
+
+// GetCouponByID returns a coupon from the database by ID
+func (p *CouponPersistence) GetCouponByID(id int) (*models.Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	coupon, err := scanCoupon(p.db.QueryRowContext(ctx, "SELECT "+couponColumns+" FROM coupons c WHERE c.id = $1", id))
+	if err != nil {
+		log.Println("Error querying coupon by ID:", err)
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// GetCouponByCode returns a coupon from the database by its code, ignoring case
+func (p *CouponPersistence) GetCouponByCode(code string) (*models.Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	coupon, err := scanCoupon(p.db.QueryRowContext(ctx, "SELECT "+couponColumns+" FROM coupons c WHERE UPPER(c.code) = UPPER($1)", code))
+	if err != nil {
+		log.Println("Error querying coupon by code:", err)
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// InsertCoupon inserts a new coupon into the database
+func (p *CouponPersistence) InsertCoupon(coupon models.Coupon) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	amount, currency := couponAmount(coupon)
+	stmt := `INSERT INTO coupons (code, kind, percent, amount, currency, duration, duration_cycles, max_redemptions,
+        expires_at, active, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id`
+
+	var id int
+	err := p.db.QueryRowContext(ctx, stmt, coupon.Code, coupon.Kind, coupon.Percent.String(), amount, currency,
+		coupon.Duration, coupon.DurationCycles, coupon.MaxRedemptions, coupon.ExpiresAt, coupon.Active,
+		time.Now(), time.Now()).Scan(&id)
+	if err != nil {
+		log.Println("Error inserting coupon:", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// UpdateCoupon updates a coupon in the database. The redemption count is left untouched.
+func (p *CouponPersistence) UpdateCoupon(coupon models.Coupon) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	amount, currency := couponAmount(coupon)
+	stmt := `UPDATE coupons SET code = $1, kind = $2, percent = $3, amount = $4, currency = $5, duration = $6,
+        duration_cycles = $7, max_redemptions = $8, expires_at = $9, active = $10, updated_at = $11 WHERE id = $12`
+
+	_, err := p.db.ExecContext(ctx, stmt, coupon.Code, coupon.Kind, coupon.Percent.String(), amount, currency,
+		coupon.Duration, coupon.DurationCycles, coupon.MaxRedemptions, coupon.ExpiresAt, coupon.Active,
+		time.Now(), coupon.ID)
+	if err != nil {
+		log.Println("Error updating coupon:", err)
+		return err
+	}
+	return nil
+}
+
+// DeactivateCoupon stops a coupon from being redeemed. Coupons are never deleted so that the
+// subscriptions that redeemed one keep their discount.
+func (p *CouponPersistence) DeactivateCoupon(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, "UPDATE coupons SET active = FALSE, updated_at = $1 WHERE id = $2", time.Now(), id)
+	if err != nil {
+		log.Println("Error deactivating coupon:", err)
+		return err
+	}
+	return nil
+}
+
+// Redeem applies the coupon to the subscription, counting the redemption against the coupon's
+// limit in the same transaction. It returns ErrCouponUnavailable if the coupon can no longer be
+// redeemed and ErrCouponAlreadyApplied if the subscription already has a coupon.
+func (p *CouponPersistence) Redeem(couponID, subscriptionID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := begin(ctx, p.db)
+	if err != nil {
+		log.Println("Error starting coupon redemption transaction:", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE coupons SET times_redeemed = times_redeemed + 1
+        WHERE id = $1 AND active AND (expires_at IS NULL OR expires_at > $2)
+        AND (max_redemptions = 0 OR times_redeemed < max_redemptions)`, couponID, time.Now())
+	if err != nil {
+		log.Println("Error counting coupon redemption:", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Println("Error counting coupon redemption:", err)
+		return err
+	}
+	if n == 0 {
+		return ErrCouponUnavailable
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO coupon_redemptions (coupon_id, subscription_id, redeemed_at) VALUES ($1, $2, $3)",
+		couponID, subscriptionID, time.Now())
+	if isUniqueViolation(err, "coupon_redemptions_subscription_key") {
+		return ErrCouponAlreadyApplied
+	}
+	if err != nil {
+		log.Println("Error inserting coupon redemption:", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRedemption returns the coupon redeemed for the subscription together with the number of cycle
+// invoices issued since, or nil if the subscription has no coupon
+func (p *CouponPersistence) GetRedemption(subscriptionID int) (*models.CouponRedemption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `SELECT r.id, r.coupon_id, r.subscription_id, r.redeemed_at,
+        (SELECT COUNT(DISTINCT i.id) FROM invoices i JOIN invoice_line_items li ON li.invoice_id = i.id
+            WHERE li.subscription_id = r.subscription_id AND i.kind = 'CYCLE' AND i.created_at >= r.redeemed_at),
+        ` + couponColumns + `
+        FROM coupon_redemptions r JOIN coupons c ON c.id = r.coupon_id
+        WHERE r.subscription_id = $1`
+
+	var redemption models.CouponRedemption
+	coupon, err := scanCoupon(p.db.QueryRowContext(ctx, query, subscriptionID), &redemption.ID, &redemption.CouponID,
+		&redemption.SubscriptionID, &redemption.RedeemedAt, &redemption.CyclesApplied)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println("Error querying coupon redemption:", err)
+		return nil, err
+	}
+	redemption.Coupon = *coupon
+
+	return &redemption, nil
+}
+
+// couponAmount returns the NUMERIC amount and currency stored for the coupon's fixed discount
+func couponAmount(coupon models.Coupon) (string, string) {
+	if coupon.Amount == nil {
+		return "0", ""
+	}
+	return coupon.Amount.String(), coupon.Amount.Currency
+}
+
+// scanCoupon reads one row selected as couponColumns, preceded by the given leading destinations
+func scanCoupon(row rowScanner, leading ...any) (*models.Coupon, error) {
+	var coupon models.Coupon
+	var percent, amount, currency string
+	var expiresAt sql.NullTime
+
+	dest := append(leading, &coupon.ID, &coupon.Code, &coupon.Kind, &percent, &amount, &currency, &coupon.Duration,
+		&coupon.DurationCycles, &coupon.MaxRedemptions, &coupon.TimesRedeemed, &expiresAt, &coupon.Active,
+		&coupon.CreatedAt, &coupon.UpdatedAt)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if coupon.Percent, err = money.ParsePercent(percent); err != nil {
+		return nil, err
+	}
+	if currency != "" {
+		parsed, err := money.Parse(amount, currency)
+		if err != nil {
+			return nil, err
+		}
+		coupon.Amount = &parsed
+	}
+	if expiresAt.Valid {
+		coupon.ExpiresAt = &expiresAt.Time
+	}
+
+	return &coupon, nil
+}
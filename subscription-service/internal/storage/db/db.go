@@ -1,7 +1,43 @@
 package db
 
 import (
+	"errors"
+	"subscription-service/internal/pkg/money"
 	"time"
+
+	"github.com/jackc/pgconn"
 )
 
 const dbTimeout = time.Second * 3
+
+// uniqueViolation is the Postgres SQLSTATE raised when a unique constraint is violated
+const uniqueViolation = "23505"
+
+// isUniqueViolation reports whether err was caused by the named unique constraint
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == constraint
+}
+
+// maxErrorLength is the length of the columns recording error messages
+const maxErrorLength = 255
+
+// truncate shortens s to at most n characters so that it fits a VARCHAR(n) column
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+// parseMoney parses the NUMERIC column values into the amounts they belong to, all in currency
+func parseMoney(currency string, amounts []*money.Money, values []string) error {
+	for i, amount := range amounts {
+		parsed, err := money.Parse(values[i], currency)
+		if err != nil {
+			return err
+		}
+		*amount = parsed
+	}
+	return nil
+}
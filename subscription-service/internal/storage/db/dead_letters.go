@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"subscription-service/internal/constants/models"
+	"time"
+)
+
+// ErrDeadLetterReplayed is returned when replaying a dead letter that has already been replayed
+var ErrDeadLetterReplayed = errors.New("dead letter has already been replayed")
+
+// deadLetterColumns lists the dead letter columns in the order scanDeadLetter reads them
+const deadLetterColumns = "id, message_id, routing_key, payload, reason, attempts, created_at, replayed_at"
+
+type DeadLetterPersistence struct {
+	db DBTX
+}
+
+// NewDeadLetterPersistence is the function used to create an instance of the DeadLetterPersistence.
+func NewDeadLetterPersistence(dbPool *sql.DB) DeadLetterPersistence {
+	return DeadLetterPersistence{db: dbPool}
+}
+
+// WithTx returns a DeadLetterPersistence that runs its statements in the unit of work's transaction tx
+func (p *DeadLetterPersistence) WithTx(tx *sql.Tx) DeadLetterPersistence {
+	return DeadLetterPersistence{db: tx}
+}
+
+// AddDeadLetter stores a message the consumer gave up on
+func (p *DeadLetterPersistence) AddDeadLetter(letter models.DeadLetter) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `INSERT INTO dead_letters (message_id, routing_key, payload, reason, attempts, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+	var id int
+	err := p.db.QueryRowContext(ctx, stmt, letter.MessageID, letter.RoutingKey, letter.Payload,
+		truncate(letter.Reason, maxErrorLength), letter.Attempts, time.Now()).Scan(&id)
+	if err != nil {
+		log.Println("Error inserting dead letter:", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetDeadLetters returns the dead letters, newest first. Unless replayed is set, dead letters that
+// have already been replayed are left out.
+func (p *DeadLetterPersistence) GetDeadLetters(replayed bool) ([]models.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, "SELECT "+deadLetterColumns+" FROM dead_letters WHERE $1 OR replayed_at IS NULL ORDER BY id DESC", replayed)
+	if err != nil {
+		log.Println("Error querying dead letters:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []models.DeadLetter
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			log.Println("Error scanning dead letter row:", err)
+			return nil, err
+		}
+		letters = append(letters, *letter)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating through dead letters:", err)
+		return nil, err
+	}
+
+	return letters, nil
+}
+
+// GetDeadLetterByID returns one dead letter by ID
+func (p *DeadLetterPersistence) GetDeadLetterByID(id int) (*models.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	letter, err := scanDeadLetter(p.db.QueryRowContext(ctx, "SELECT "+deadLetterColumns+" FROM dead_letters WHERE id = $1", id))
+	if err != nil {
+		log.Println("Error querying dead letter by ID:", err)
+		return nil, err
+	}
+	return letter, nil
+}
+
+// MarkReplayed records that the dead letter was published again. It returns ErrDeadLetterReplayed if
+// it had already been replayed, so that a message is not replayed twice by concurrent requests.
+func (p *DeadLetterPersistence) MarkReplayed(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	res, err := p.db.ExecContext(ctx, "UPDATE dead_letters SET replayed_at = $1 WHERE id = $2 AND replayed_at IS NULL", time.Now(), id)
+	if err != nil {
+		log.Println("Error marking dead letter replayed:", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Println("Error marking dead letter replayed:", err)
+		return err
+	}
+	if n == 0 {
+		return ErrDeadLetterReplayed
+	}
+	return nil
+}
+
+func scanDeadLetter(row rowScanner) (*models.DeadLetter, error) {
+	var letter models.DeadLetter
+	var replayedAt sql.NullTime
+
+	err := row.Scan(&letter.ID, &letter.MessageID, &letter.RoutingKey, &letter.Payload, &letter.Reason,
+		&letter.Attempts, &letter.CreatedAt, &replayedAt)
+	if err != nil {
+		return nil, err
+	}
+	if replayedAt.Valid {
+		letter.ReplayedAt = &replayedAt.Time
+	}
+
+	return &letter, nil
+}
@@ -3,13 +3,28 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"subscription-service/internal/constants/models"
 	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
+	"time"
 )
 
+// ErrSubscriptionAlreadyBilled is returned when the billing period already has an invoice or another
+// invoice advanced the subscription first.
+var ErrSubscriptionAlreadyBilled = errors.New("subscription cycle has already been billed")
+
+// ErrInvoiceStatus is returned when an invoice is marked paid or void from a status that does not allow it
+var ErrInvoiceStatus = errors.New("invoice status does not allow this change")
+
+// invoicePeriodKey is the unique (subscription_id, period_start) index on cycle invoices
+const invoicePeriodKey = "invoices_subscription_period_key"
+
 type InvoicePersistence struct {
-	db *sql.DB
+	db DBTX
 }
 
 // NewInvoicePersistence is the function used to create an instance of the InvoicePersistence.
@@ -17,15 +32,33 @@ func NewInvoicePersistence(dbPool *sql.DB) InvoicePersistence {
 	return InvoicePersistence{db: dbPool}
 }
 
+// WithTx returns a InvoicePersistence that runs its statements in the unit of work's transaction tx
+func (p *InvoicePersistence) WithTx(tx *sql.Tx) InvoicePersistence {
+	return InvoicePersistence{db: tx}
+}
+
+// failedInvoiceColumns are the columns scanFailedInvoice reads, in order
+const failedInvoiceColumns = "id, subscription_id, invoice_id, invoice_date, email_retry, next_attempt_at, last_error, status"
+
+// scanFailedInvoice reads a failed invoice selected with failedInvoiceColumns
+func scanFailedInvoice(row rowScanner) (models.FailedInvoice, error) {
+	var invoice models.FailedInvoice
+	err := row.Scan(&invoice.ID, &invoice.SubscriptionID, &invoice.InvoiceID, &invoice.InvoiceDate, &invoice.EmailRetry,
+		&invoice.NextAttemptAt, &invoice.LastError, &invoice.Status)
+	return invoice, err
+}
+
 // AddFailedInvoice adds a failed invoice record to the database
 func (p *InvoicePersistence) AddFailedInvoice(failedInvoice models.FailedInvoice) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := "INSERT INTO failed_invoices (subscription_id, invoice_id, invoice_date, email_retry) VALUES ($1, $2, $3, $4) RETURNING id"
+	stmt := `INSERT INTO failed_invoices (subscription_id, invoice_id, invoice_date, email_retry, next_attempt_at, last_error, status)
+        VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
 
 	var id int
-	err := p.db.QueryRowContext(ctx, stmt, failedInvoice.SubscriptionID, failedInvoice.InvoiceID, failedInvoice.InvoiceDate, failedInvoice.EmailRetry).Scan(&id)
+	err := p.db.QueryRowContext(ctx, stmt, failedInvoice.SubscriptionID, failedInvoice.InvoiceID, failedInvoice.InvoiceDate, failedInvoice.EmailRetry,
+		failedInvoice.NextAttemptAt, truncate(failedInvoice.LastError, maxErrorLength), failedInvoice.Status).Scan(&id)
 	if err != nil {
 		log.Println("Error inserting failed invoice:", err)
 		return 0, err
@@ -33,14 +66,15 @@ func (p *InvoicePersistence) AddFailedInvoice(failedInvoice models.FailedInvoice
 	return id, nil
 }
 
-// UpdateInvoice updates an existing invoice record in the database
-func (p *InvoicePersistence) UpdateInvoice(invoiceID string, newEmailRetry int) error {
+// UpdateInvoice records the attempts, next attempt, last error and status of a failed invoice
+func (p *InvoicePersistence) UpdateInvoice(failedInvoice models.FailedInvoice) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := "UPDATE failed_invoices SET email_retry = $1 WHERE invoice_id = $2"
+	stmt := "UPDATE failed_invoices SET email_retry = $1, next_attempt_at = $2, last_error = $3, status = $4 WHERE invoice_id = $5"
 
-	_, err := p.db.ExecContext(ctx, stmt, newEmailRetry, invoiceID)
+	_, err := p.db.ExecContext(ctx, stmt, failedInvoice.EmailRetry, failedInvoice.NextAttemptAt,
+		truncate(failedInvoice.LastError, maxErrorLength), failedInvoice.Status, failedInvoice.InvoiceID)
 	if err != nil {
 		log.Println("Error updating invoice:", err)
 		return err
@@ -48,9 +82,49 @@ func (p *InvoicePersistence) UpdateInvoice(invoiceID string, newEmailRetry int)
 	return nil
 }
 
-// GetAllFailedInvoices returns all invoice records from the database
-func (p *InvoicePersistence) GetAllFailedInvoices() ([]models.FailedInvoice, error) {
-	rows, err := p.db.Query("SELECT id, subscription_id, invoice_id, invoice_date, email_retry FROM failed_invoices WHERE email_retry < $1", states.MAX_EMAIL_RETRY)
+// GetAllFailedInvoices returns the failed invoice records matching the filter, oldest first
+func (p *InvoicePersistence) GetAllFailedInvoices(filter models.FailedInvoiceFilter) ([]models.FailedInvoice, error) {
+	var f filters
+	if filter.Status != "" {
+		f.add("status = ?", filter.Status)
+	}
+	if filter.SubscriptionID != 0 {
+		f.add("subscription_id = ?", filter.SubscriptionID)
+	}
+	if !filter.From.IsZero() {
+		f.add("invoice_date >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		f.add("invoice_date < ?", filter.To.AddDate(0, 0, 1))
+	}
+
+	return p.queryFailedInvoices("SELECT "+failedInvoiceColumns+" FROM failed_invoices"+f.where()+" ORDER BY id", f.args...)
+}
+
+// GetFailedInvoiceByID returns one failed invoice record
+func (p *InvoicePersistence) GetFailedInvoiceByID(id int) (models.FailedInvoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	invoice, err := scanFailedInvoice(p.db.QueryRowContext(ctx, "SELECT "+failedInvoiceColumns+" FROM failed_invoices WHERE id = $1", id))
+	if err != nil {
+		log.Println("Error querying failed invoice by ID:", err)
+		return models.FailedInvoice{}, err
+	}
+	return invoice, nil
+}
+
+// GetDueFailedInvoices returns the failed invoices still being retried whose next attempt is due at now
+func (p *InvoicePersistence) GetDueFailedInvoices(now time.Time) ([]models.FailedInvoice, error) {
+	return p.queryFailedInvoices("SELECT "+failedInvoiceColumns+` FROM failed_invoices
+        WHERE status = $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at`, states.FAILED_INVOICE_RETRYING, now)
+}
+
+func (p *InvoicePersistence) queryFailedInvoices(query string, args ...any) ([]models.FailedInvoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Println("Error querying invoices:", err)
 		return nil, err
@@ -59,8 +133,8 @@ func (p *InvoicePersistence) GetAllFailedInvoices() ([]models.FailedInvoice, err
 
 	var invoices []models.FailedInvoice
 	for rows.Next() {
-		var invoice models.FailedInvoice
-		if err := rows.Scan(&invoice.ID, &invoice.SubscriptionID, &invoice.InvoiceID, &invoice.InvoiceDate, &invoice.EmailRetry); err != nil {
+		invoice, err := scanFailedInvoice(rows)
+		if err != nil {
 			log.Println("Error scanning invoice row:", err)
 			return nil, err
 		}
@@ -89,3 +163,339 @@ func (p *InvoicePersistence) DeleteInvoice(invoiceID string) error {
 	}
 	return nil
 }
+
+// AddInvoice allocates the next invoice number for the invoice year and inserts the invoice and its
+// line items into the ledger in a single transaction, a savepoint of the unit of work's transaction
+// when bound with WithTx. It returns the ID and number of the new invoice.
+// Because the counter row stays locked until commit and is rolled back with the invoice, concurrent
+// callers never receive duplicate numbers and a failed insert never leaves a gap.
+//
+// Every subscription in changes is moved to its change.To in the same transaction, recording an audit
+// event if its plan or status changes. The updates only apply if each subscription is still in the
+// state of its change.From, otherwise one was billed or changed concurrently,
+// ErrSubscriptionAlreadyBilled is returned and nothing is written.
+func (p *InvoicePersistence) AddInvoice(invoice models.InvoiceRecord, numbering models.InvoiceNumbering, changes []models.SubscriptionChange) (int, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := begin(ctx, p.db)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	year := invoice.InvoiceDate.Year()
+	seqStmt := `INSERT INTO invoice_number_sequences (year, last_number) VALUES ($1, 1)
+        ON CONFLICT (year) DO UPDATE SET last_number = invoice_number_sequences.last_number + 1
+        RETURNING last_number
+    `
+
+	var sequence int
+	if err = tx.QueryRowContext(ctx, seqStmt, year).Scan(&sequence); err != nil {
+		log.Println("Error allocating invoice number:", err)
+		return 0, "", err
+	}
+	invoice.InvoiceNumber = numbering.Format(year, sequence)
+
+	stmt := `INSERT INTO invoices (invoice_number, kind, subscription_id, billing_run_id, user_id, period_start, period_end, invoice_date, due_date, subtotal, tax_total, total, currency, tax_note,
+        billing_name, billing_address, billing_address_2, billing_postal_code, billing_city, billing_country, billing_vat_id, pdf_location, status, created_at, updated_at)
+        VALUES ($1, $2, $3, NULLIF($4, 0), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25) RETURNING id
+    `
+
+	var id int
+	err = tx.QueryRowContext(ctx, stmt,
+		invoice.InvoiceNumber,
+		invoice.Kind,
+		invoice.SubscriptionID,
+		invoice.BillingRunID,
+		invoice.UserID,
+		invoice.PeriodStart,
+		invoice.PeriodEnd,
+		invoice.InvoiceDate,
+		invoice.DueDate,
+		invoice.Subtotal.String(),
+		invoice.TaxTotal.String(),
+		invoice.Total.String(),
+		invoice.Total.Currency,
+		invoice.TaxNote,
+		invoice.BillingName,
+		invoice.BillingAddress.Address,
+		invoice.BillingAddress.Address2,
+		invoice.BillingAddress.PostalCode,
+		invoice.BillingAddress.City,
+		invoice.BillingAddress.Country,
+		invoice.BillingAddress.VatID,
+		invoice.PDFLocation,
+		invoice.Status,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+	if isUniqueViolation(err, invoicePeriodKey) {
+		return 0, "", ErrSubscriptionAlreadyBilled
+	}
+	if err != nil {
+		log.Println("Error inserting invoice:", err)
+		return 0, "", err
+	}
+
+	itemStmt := `INSERT INTO invoice_line_items (invoice_id, subscription_id, name, description, unit_cost, quantity, tax, tax_amount, discount, amount)
+        VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7, $8, $9, $10)
+    `
+	for _, item := range invoice.LineItems {
+		_, err = tx.ExecContext(ctx, itemStmt, id, item.SubscriptionID, item.Name, item.Description, item.UnitCost.String(), item.Quantity, item.Tax.String(), item.TaxAmount.String(), item.Discount.String(), item.Amount.String())
+		if err != nil {
+			log.Println("Error inserting invoice line item:", err)
+			return 0, "", err
+		}
+	}
+
+	for _, change := range changes {
+		updated, err := updateSubscription(ctx, tx, change)
+		if err != nil {
+			log.Println("Error updating subscription billing:", err)
+			return 0, "", err
+		}
+		if !updated {
+			return 0, "", ErrSubscriptionAlreadyBilled
+		}
+
+		if event, ok := changeEvent(change); ok {
+			if err = addSubscriptionEvent(ctx, tx, event); err != nil {
+				return 0, "", err
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println("Error committing invoice:", err)
+		return 0, "", err
+	}
+
+	return id, invoice.InvoiceNumber, nil
+}
+
+// UpdateInvoiceStatus moves a ledger invoice to a new lifecycle status, optionally recording the
+// invoice store key and checksum of its PDF
+func (p *InvoicePersistence) UpdateInvoiceStatus(id int, status string, pdfLocation string, pdfChecksum string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE invoices SET status = $1, pdf_location = COALESCE(NULLIF($2, ''), pdf_location),
+        pdf_checksum = COALESCE(NULLIF($3, ''), pdf_checksum), updated_at = $4 WHERE id = $5`
+
+	_, err := p.db.ExecContext(ctx, stmt, status, pdfLocation, pdfChecksum, time.Now(), id)
+	if err != nil {
+		log.Println("Error updating invoice status:", err)
+		return err
+	}
+	return nil
+}
+
+// MarkInvoicePaid records the payment of an issued or sent invoice. It returns sql.ErrNoRows if there is
+// no such invoice and ErrInvoiceStatus if the invoice is still a draft, already paid or void.
+func (p *InvoicePersistence) MarkInvoicePaid(invoiceNumber string) error {
+	return p.transitionInvoice(invoiceNumber, states.INVOICE_PAID, states.INVOICE_ISSUED, states.INVOICE_SENT)
+}
+
+// VoidInvoice cancels an invoice that has not been paid. It returns sql.ErrNoRows if there is no such
+// invoice and ErrInvoiceStatus if the invoice is already paid or void.
+func (p *InvoicePersistence) VoidInvoice(invoiceNumber string) error {
+	return p.transitionInvoice(invoiceNumber, states.INVOICE_VOID, states.INVOICE_DRAFT, states.INVOICE_ISSUED, states.INVOICE_SENT)
+}
+
+// transitionInvoice moves an invoice to the status to, provided its current status is one of from
+func (p *InvoicePersistence) transitionInvoice(invoiceNumber string, to string, from ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	args := []any{to, time.Now(), invoiceNumber}
+	placeholders := make([]string, len(from))
+	for i, status := range from {
+		args = append(args, status)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+	stmt := "UPDATE invoices SET status = $1, updated_at = $2 WHERE invoice_number = $3 AND status IN (" +
+		strings.Join(placeholders, ", ") + ")"
+
+	res, err := p.db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		log.Println("Error updating invoice status:", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Println("Error updating invoice status:", err)
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = p.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM invoices WHERE invoice_number = $1)", invoiceNumber).Scan(&exists)
+	if err != nil {
+		log.Println("Error querying invoice:", err)
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return ErrInvoiceStatus
+}
+
+// UpdateInvoicePDF records the invoice store key and checksum of a ledger invoice's PDF, leaving its
+// status as it is
+func (p *InvoicePersistence) UpdateInvoicePDF(id int, pdfLocation string, pdfChecksum string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := "UPDATE invoices SET pdf_location = $1, pdf_checksum = $2, updated_at = $3 WHERE id = $4"
+
+	_, err := p.db.ExecContext(ctx, stmt, pdfLocation, pdfChecksum, time.Now(), id)
+	if err != nil {
+		log.Println("Error updating invoice PDF:", err)
+		return err
+	}
+	return nil
+}
+
+// invoiceColumns lists the invoice columns in the order scanInvoice reads them
+const invoiceColumns = `id, invoice_number, kind, subscription_id, COALESCE(billing_run_id, 0), user_id, period_start,
+        period_end, invoice_date, due_date, subtotal, tax_total, total, currency, tax_note, billing_name, billing_address,
+        billing_address_2, billing_postal_code, billing_city, billing_country, billing_vat_id, pdf_location, pdf_checksum,
+        status, created_at, updated_at`
+
+// invoiceSortFields are the fields invoice lists can be ordered by
+var invoiceSortFields = map[string]sortField[*models.InvoiceRecord]{
+	"id":    {column: "id", cast: "integer", value: func(i *models.InvoiceRecord) string { return fmt.Sprint(i.ID) }},
+	"total": {column: "total", cast: "numeric", value: func(i *models.InvoiceRecord) string { return i.Total.String() }},
+	"invoice_date": {column: "invoice_date", cast: "timestamp", value: func(i *models.InvoiceRecord) string {
+		return i.InvoiceDate.Format(time.RFC3339Nano)
+	}},
+}
+
+// ListUserInvoices returns one page of the user's ledger invoices matching the filter, without their
+// line items. It returns ErrInvalidSort or ErrInvalidCursor for pages that cannot be listed.
+func (p *InvoicePersistence) ListUserInvoices(userID int, filter models.InvoiceFilter, page models.PageRequest) (models.Page[*models.InvoiceRecord], error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var f filters
+	f.add("user_id = ?", userID)
+	if filter.Status != "" {
+		f.add("status = ?", filter.Status)
+	}
+	if !filter.From.IsZero() {
+		f.add("invoice_date >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		f.add("invoice_date < ?", filter.To.AddDate(0, 0, 1))
+	}
+
+	result, err := listPage(ctx, p.db, "invoices", invoiceColumns, invoiceSortFields, f, page,
+		func(i *models.InvoiceRecord) int { return i.ID }, scanInvoice)
+	if err != nil && !errors.Is(err, ErrInvalidSort) && !errors.Is(err, ErrInvalidCursor) {
+		log.Println("Error listing invoices:", err)
+	}
+	return result, err
+}
+
+// GetInvoiceByNumber returns one ledger invoice, including its line items, by invoice number
+func (p *InvoicePersistence) GetInvoiceByNumber(invoiceNumber string) (*models.InvoiceRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	invoice, err := scanInvoice(p.db.QueryRowContext(ctx, "SELECT "+invoiceColumns+" FROM invoices WHERE invoice_number = $1", invoiceNumber))
+	if err != nil {
+		log.Println("Error querying invoice by number:", err)
+		return nil, err
+	}
+
+	items, err := p.getLineItems(ctx, invoice.ID, invoice.Total.Currency)
+	if err != nil {
+		return nil, err
+	}
+	invoice.LineItems = items
+
+	return invoice, nil
+}
+
+// scanInvoice reads one row selected as invoiceColumns
+func scanInvoice(row rowScanner) (*models.InvoiceRecord, error) {
+	var invoice models.InvoiceRecord
+	var subtotal, taxTotal, total, currency string
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.InvoiceNumber,
+		&invoice.Kind,
+		&invoice.SubscriptionID,
+		&invoice.BillingRunID,
+		&invoice.UserID,
+		&invoice.PeriodStart,
+		&invoice.PeriodEnd,
+		&invoice.InvoiceDate,
+		&invoice.DueDate,
+		&subtotal,
+		&taxTotal,
+		&total,
+		&currency,
+		&invoice.TaxNote,
+		&invoice.BillingName,
+		&invoice.BillingAddress.Address,
+		&invoice.BillingAddress.Address2,
+		&invoice.BillingAddress.PostalCode,
+		&invoice.BillingAddress.City,
+		&invoice.BillingAddress.Country,
+		&invoice.BillingAddress.VatID,
+		&invoice.PDFLocation,
+		&invoice.PDFChecksum,
+		&invoice.Status,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = parseMoney(currency, []*money.Money{&invoice.Subtotal, &invoice.TaxTotal, &invoice.Total}, []string{subtotal, taxTotal, total}); err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
+
+func (p *InvoicePersistence) getLineItems(ctx context.Context, invoiceID int, currency string) ([]models.InvoiceLineItem, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT id, invoice_id, COALESCE(subscription_id, 0), name, description, unit_cost, quantity, tax, tax_amount, discount, amount
+        FROM invoice_line_items WHERE invoice_id = $1 ORDER BY id`, invoiceID)
+	if err != nil {
+		log.Println("Error querying invoice line items:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.InvoiceLineItem
+	for rows.Next() {
+		var item models.InvoiceLineItem
+		var unitCost, rate, taxAmount, discount, amount string
+		if err := rows.Scan(&item.ID, &item.InvoiceID, &item.SubscriptionID, &item.Name, &item.Description, &unitCost, &item.Quantity, &rate, &taxAmount, &discount, &amount); err != nil {
+			log.Println("Error scanning invoice line item row:", err)
+			return nil, err
+		}
+		if err := parseMoney(currency, []*money.Money{&item.UnitCost, &item.TaxAmount, &item.Discount, &item.Amount}, []string{unitCost, taxAmount, discount, amount}); err != nil {
+			return nil, err
+		}
+		tax, err := money.ParsePercent(rate)
+		if err != nil {
+			return nil, err
+		}
+		item.Tax = tax
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating through invoice line items:", err)
+		return nil, err
+	}
+
+	return items, nil
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"subscription-service/internal/constants/models"
+	"time"
+)
+
+var (
+	// ErrInvalidCursor is returned for cursors that are malformed or were issued for another sort order
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidSort is returned when sorting by a field the list cannot be ordered by
+	ErrInvalidSort = errors.New("invalid sort field")
+)
+
+// sortField is a field a list can be ordered by. The cursor stores the field's value of the last row
+// as text, which is cast back to the column's SQL type when the next page is queried.
+type sortField[T any] struct {
+	column string
+	cast   string
+	value  func(T) string
+}
+
+// cursor identifies the last row of a page by its sort value and ID
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reads a cursor issued for the sort order sort on field. The cursor's value must parse as
+// the field's SQL type, so that a tampered cursor is rejected here rather than failing the cast in
+// the query.
+func decodeCursor[T any](s, sort string, field sortField[T]) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Sort != sort {
+		return c, ErrInvalidCursor
+	}
+
+	switch field.cast {
+	case "integer":
+		_, err = strconv.ParseInt(c.Value, 10, 32)
+	case "numeric":
+		if !decimalPattern.MatchString(c.Value) {
+			err = ErrInvalidCursor
+		}
+	case "timestamp":
+		_, err = time.Parse(time.RFC3339Nano, c.Value)
+	}
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// decimalPattern matches the numeric values money.Money formats
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// filters collects the WHERE conditions of a list query. Conditions use ? for their arguments, which
+// are numbered $1, $2, ... in the order the conditions are added.
+type filters struct {
+	conditions []string
+	args       []any
+}
+
+func (f *filters) add(condition string, args ...any) {
+	for _, arg := range args {
+		f.args = append(f.args, arg)
+		condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(f.args)), 1)
+	}
+	f.conditions = append(f.conditions, condition)
+}
+
+func (f *filters) where() string {
+	if len(f.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+// listPage queries one page of table, filtered by f and ordered by the sort field named in page.Sort
+// and then by id, using keyset pagination so that pages stay stable while rows are added. scan
+// reads the given columns and id returns a row's ID.
+func listPage[T any](ctx context.Context, db DBTX, table, columns string, sortFields map[string]sortField[T], f filters,
+	page models.PageRequest, id func(T) int, scan func(rowScanner) (T, error)) (models.Page[T], error) {
+	result := models.Page[T]{Items: []T{}}
+
+	name, descending := strings.CutPrefix(page.Sort, "-")
+	if name == "" {
+		name = "id"
+	}
+	field, ok := sortFields[name]
+	if !ok {
+		return result, fmt.Errorf("%w: %q", ErrInvalidSort, name)
+	}
+
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+f.where(), f.args...).Scan(&result.TotalCount); err != nil {
+		return result, err
+	}
+
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if page.Cursor != "" {
+		c, err := decodeCursor(page.Cursor, page.Sort, field)
+		if err != nil {
+			return result, err
+		}
+		f.add(fmt.Sprintf("(%s, id) %s (CAST(? AS TEXT)::%s, ?)", field.column, comparison, field.cast), c.Value, c.ID)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s %s, id %s LIMIT %d",
+		columns, table, f.where(), field.column, direction, direction, page.Limit+1)
+
+	rows, err := db.QueryContext(ctx, query, f.args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return result, err
+		}
+		result.Items = append(result.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(result.Items) > page.Limit {
+		result.Items = result.Items[:page.Limit]
+		last := result.Items[page.Limit-1]
+		result.NextCursor = encodeCursor(cursor{Sort: page.Sort, Value: field.value(last), ID: id(last)})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/money"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	subscription := &models.Subscription{
+		ID:                42,
+		Status:            "ACTIVE",
+		Price:             money.New(-19950, "EUR"),
+		NextBillingDate:   time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		ContractStartDate: time.Date(2024, time.January, 31, 12, 30, 0, 500, time.UTC),
+	}
+
+	for name, field := range subscriptionSortFields {
+		for _, sort := range []string{name, "-" + name} {
+			want := cursor{Sort: sort, Value: field.value(subscription), ID: subscription.ID}
+
+			got, err := decodeCursor(encodeCursor(want), sort, field)
+			if err != nil {
+				t.Errorf("decodeCursor(%s) = %v", sort, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("decodeCursor(%s) = %+v, want %+v", sort, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeCursorRejectsTamperedValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		sort  string
+		value string
+	}{
+		{"text for an integer", "id", "abc"},
+		{"integer out of range", "id", "99999999999"},
+		{"text for a numeric", "price", "cheap"},
+		{"exponent for a numeric", "-price", "1e5"},
+		{"text for a timestamp", "next_billing_date", "tomorrow"},
+		{"date without time", "contract_start_date", "2024-01-31"},
+	}
+
+	for _, tt := range tests {
+		name := tt.sort
+		if name[0] == '-' {
+			name = name[1:]
+		}
+		field := subscriptionSortFields[name]
+
+		_, err := decodeCursor(encodeCursor(cursor{Sort: tt.sort, Value: tt.value, ID: 1}), tt.sort, field)
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: decodeCursor = %v, want ErrInvalidCursor", tt.name, err)
+		}
+	}
+}
+
+func TestDecodeCursorRejectsMalformedCursors(t *testing.T) {
+	field := subscriptionSortFields["id"]
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("id=1"))},
+		{"another sort order", encodeCursor(cursor{Sort: "-id", Value: "1", ID: 1})},
+	}
+
+	for _, tt := range tests {
+		if _, err := decodeCursor(tt.cursor, "id", field); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: decodeCursor = %v, want ErrInvalidCursor", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+type LockPersistence struct {
+	db *sql.DB
+}
+
+// NewLockPersistence is the function used to create an instance of the LockPersistence.
+func NewLockPersistence(dbPool *sql.DB) LockPersistence {
+	return LockPersistence{db: dbPool}
+}
+
+// TryLock attempts to take the session-level Postgres advisory lock identified by key without
+// blocking. The lock is held on a dedicated connection until release is called. If the holding
+// instance dies its connection is closed and Postgres frees the lock, so another instance can
+// take over on its next attempt.
+func (p *LockPersistence) TryLock(key int64) (release func(), acquired bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, false, err
+	}
+
+	release = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key); err != nil {
+			log.Println("Error releasing advisory lock:", err)
+		}
+		conn.Close()
+	}
+
+	return release, true, nil
+}
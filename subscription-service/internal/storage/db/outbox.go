@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"subscription-service/internal/constants/models"
+	"time"
+)
+
+type OutboxPersistence struct {
+	db DBTX
+}
+
+// NewOutboxPersistence is the function used to create an instance of the OutboxPersistence.
+func NewOutboxPersistence(dbPool *sql.DB) OutboxPersistence {
+	return OutboxPersistence{db: dbPool}
+}
+
+// WithTx returns a OutboxPersistence that runs its statements in the unit of work's transaction tx
+func (p *OutboxPersistence) WithTx(tx *sql.Tx) OutboxPersistence {
+	return OutboxPersistence{db: tx}
+}
+
+// Add stores a message for the relay to publish with the given routing key. Called on a persistence
+// bound to a unit of work, the message is only published if the transaction commits.
+func (p *OutboxPersistence) Add(routingKey string, payload []byte) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := "INSERT INTO outbox (routing_key, payload, created_at) VALUES ($1, $2, $3) RETURNING id"
+
+	var id int64
+	err := p.db.QueryRowContext(ctx, stmt, routingKey, string(payload), time.Now()).Scan(&id)
+	if err != nil {
+		log.Println("Error inserting outbox message:", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetPending returns up to limit messages that have not been published yet, oldest first
+func (p *OutboxPersistence) GetPending(limit int) ([]models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, `SELECT id, routing_key, payload, attempts, last_error, created_at
+        FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		log.Println("Error querying outbox:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.OutboxMessage
+	for rows.Next() {
+		var message models.OutboxMessage
+		var payload string
+		if err := rows.Scan(&message.ID, &message.RoutingKey, &payload, &message.Attempts, &message.LastError, &message.CreatedAt); err != nil {
+			log.Println("Error scanning outbox row:", err)
+			return nil, err
+		}
+		message.Payload = []byte(payload)
+		messages = append(messages, message)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating through outbox:", err)
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkSent records that the broker confirmed the message
+func (p *OutboxPersistence) MarkSent(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, "UPDATE outbox SET sent_at = $1, attempts = attempts + 1, last_error = '' WHERE id = $2", time.Now(), id)
+	if err != nil {
+		log.Println("Error marking outbox message sent:", err)
+		return err
+	}
+	return nil
+}
+
+// MarkFailed records a failed publish attempt; the message stays pending
+func (p *OutboxPersistence) MarkFailed(id int64, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, "UPDATE outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2", truncate(cause.Error(), maxErrorLength), id)
+	if err != nil {
+		log.Println("Error recording outbox publish failure:", err)
+		return err
+	}
+	return nil
+}
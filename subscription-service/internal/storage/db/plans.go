@@ -3,12 +3,15 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"subscription-service/internal/constants/models"
+	"subscription-service/internal/pkg/money"
 )
 
 type PlanPersistence struct {
-	db *sql.DB
+	db DBTX
 }
 
 // NewPlansPersistence is the function used to create an instance of the PlanPersistence.
@@ -16,49 +19,52 @@ func NewPlansPersistence(dbPool *sql.DB) PlanPersistence {
 	return PlanPersistence{db: dbPool}
 }
 
-// GetAllPlans returns all plans from the database
-func (p *PlanPersistence) GetAllPlans() ([]*models.Plan, error) {
-	rows, err := p.db.Query("SELECT id, name, duration, duration_units, billing_frequency, billing_frequency_units, price, currency FROM plans")
-	if err != nil {
-		log.Println("Error querying plans:", err)
-		return nil, err
+// planColumns lists the plan columns in the order scanPlan reads them
+const planColumns = "id, name, duration, duration_units, billing_frequency, billing_frequency_units, price, currency, trial_days"
+
+// planSortFields are the fields plan lists can be ordered by
+var planSortFields = map[string]sortField[*models.Plan]{
+	"id":    {column: "id", cast: "integer", value: func(p *models.Plan) string { return fmt.Sprint(p.ID) }},
+	"name":  {column: "name", cast: "text", value: func(p *models.Plan) string { return p.Name }},
+	"price": {column: "price", cast: "numeric", value: func(p *models.Plan) string { return p.Price.String() }},
+}
+
+// ListPlans returns one page of the plans matching the filter. It returns ErrInvalidSort or
+// ErrInvalidCursor for pages that cannot be listed.
+func (p *PlanPersistence) ListPlans(filter models.PlanFilter, page models.PageRequest) (models.Page[*models.Plan], error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var f filters
+	if filter.Currency != "" {
+		f.add("currency = ?", filter.Currency)
 	}
-	defer rows.Close()
-
-	var plans []*models.Plan
-	for rows.Next() {
-		var plan models.Plan
-		if err := rows.Scan(&plan.ID, &plan.Name, &plan.Duration, &plan.DurationUnits, &plan.BillingFrequency, &plan.BillingFrequencyUnits, &plan.Price, &plan.Currency); err != nil {
-			log.Println("Error scanning plan row:", err)
-			return nil, err
-		}
-		plans = append(plans, &plan)
+	if filter.Name != "" {
+		f.add("name ILIKE '%' || ? || '%'", filter.Name)
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Println("Error iterating through plans:", err)
-		return nil, err
+	result, err := listPage(ctx, p.db, "plans", planColumns, planSortFields, f, page,
+		func(p *models.Plan) int { return p.ID }, scanPlan)
+	if err != nil && !errors.Is(err, ErrInvalidSort) && !errors.Is(err, ErrInvalidCursor) {
+		log.Println("Error listing plans:", err)
 	}
-
-	return plans, nil
+	return result, err
 }
 
 // GetPlanByID returns a plan from the database by ID
 func (p *PlanPersistence) GetPlanByID(id int) (*models.Plan, error) {
-	var plan models.Plan
-	err := p.db.QueryRow("SELECT id, name, duration, duration_units, billing_frequency, billing_frequency_units, price, currency FROM plans WHERE id = $1", id).
-		Scan(&plan.ID, &plan.Name, &plan.Duration, &plan.DurationUnits, &plan.BillingFrequency, &plan.BillingFrequencyUnits, &plan.Price, &plan.Currency)
+	plan, err := scanPlan(p.db.QueryRow("SELECT "+planColumns+" FROM plans WHERE id = $1", id))
 	if err != nil {
 		log.Println("Error querying plan by ID:", err)
 		return nil, err
 	}
-	return &plan, nil
+	return plan, nil
 }
 
 // UpdatePlan updates a plan in the database
 func (p *PlanPersistence) UpdatePlan(plan models.Plan) error {
-	_, err := p.db.Exec("UPDATE plans SET name = $1, duration = $2, duration_units = $3, billing_frequency = $4, billing_frequency_units = $5, price = $6, currency = $7 WHERE id = $8",
-		plan.Name, plan.Duration, plan.DurationUnits, plan.BillingFrequency, plan.BillingFrequencyUnits, plan.Price, plan.Currency, plan.ID)
+	_, err := p.db.Exec("UPDATE plans SET name = $1, duration = $2, duration_units = $3, billing_frequency = $4, billing_frequency_units = $5, price = $6, currency = $7, trial_days = $8 WHERE id = $9",
+		plan.Name, plan.Duration, plan.DurationUnits, plan.BillingFrequency, plan.BillingFrequencyUnits, plan.Price.String(), plan.Price.Currency, plan.TrialDays, plan.ID)
 	if err != nil {
 		log.Println("Error updating plan:", err)
 		return err
@@ -81,13 +87,31 @@ func (p *PlanPersistence) InsertPlan(plan models.Plan) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := "INSERT INTO plans (name, duration, duration_units, billing_frequency, billing_frequency_units, price, currency) VALUES ($1, $2, $3, $4, $5, $6, $7) returning id"
+	stmt := "INSERT INTO plans (name, duration, duration_units, billing_frequency, billing_frequency_units, price, currency, trial_days) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) returning id"
 
 	var id int
-	err := p.db.QueryRowContext(ctx, stmt, plan.Name, plan.Duration, plan.DurationUnits, plan.BillingFrequency, plan.BillingFrequencyUnits, plan.Price, plan.Currency).Scan(&id)
+	err := p.db.QueryRowContext(ctx, stmt, plan.Name, plan.Duration, plan.DurationUnits, plan.BillingFrequency, plan.BillingFrequencyUnits, plan.Price.String(), plan.Price.Currency, plan.TrialDays).Scan(&id)
 	if err != nil {
 		log.Println("Error inserting plan:", err)
 		return 0, err
 	}
 	return id, nil
 }
+
+// scanPlan reads one plan row selected with planColumns
+func scanPlan(row rowScanner) (*models.Plan, error) {
+	var plan models.Plan
+	var price, currency string
+
+	err := row.Scan(&plan.ID, &plan.Name, &plan.Duration, &plan.DurationUnits, &plan.BillingFrequency, &plan.BillingFrequencyUnits, &price, &currency, &plan.TrialDays)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Price, err = money.Parse(price, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plan, nil
+}
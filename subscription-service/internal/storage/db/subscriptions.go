@@ -3,13 +3,32 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
+	"subscription-service/internal/pkg/money"
 	"time"
 )
 
+var (
+	// ErrSubscriptionChanged is returned when a subscription was modified between being loaded and updated
+	ErrSubscriptionChanged = errors.New("subscription was changed concurrently")
+	// ErrDuplicateSubscription is returned when the user already subscribes to the plan for the product
+	ErrDuplicateSubscription = errors.New("user already has this plan for the product")
+)
+
+// subscriptionUserPlanKey is the unique (user_id, plan_id, product_code) constraint on subscriptions
+const subscriptionUserPlanKey = "subscriptions_user_id_plan_id_product_code_key"
+
+// subscriptionColumns lists the subscription columns in the order scanSubscription reads them
+const subscriptionColumns = `id, user_id, plan_id, contract_start_date, duration, duration_units, billing_frequency,
+        billing_frequency_units, price, currency, product_code, status, billed_cycles, next_billing_date, created_at,
+        updated_at, cancel_at_period_end, canceled_at, skipped_cycles, paused_cycles, trial_ends_at`
+
 type SubscriptionPersistence struct {
-	db *sql.DB
+	db DBTX
 }
 
 // NewSubscriptionsPersistence is the function used to create an instance of the SubscriptionPersistence.
@@ -17,61 +36,21 @@ func NewSubscriptionsPersistence(dbPool *sql.DB) SubscriptionPersistence {
 	return SubscriptionPersistence{db: dbPool}
 }
 
-// GetAll returns a slice of all subscriptions, sorted by ID
-func (s *SubscriptionPersistence) GetAll() ([]*models.Subscription, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `SELECT * FROM subscriptions ORDER BY id`
-
-	rows, err := s.db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var subscriptions []*models.Subscription
-
-	for rows.Next() {
-		var subscription models.Subscription
-		err := rows.Scan(
-			&subscription.ID,
-			&subscription.UserID,
-			&subscription.PlanID,
-			&subscription.ContractStartDate,
-			&subscription.Duration,
-			&subscription.DurationUnits,
-			&subscription.BillingFrequency,
-			&subscription.BillingFrequencyUnits,
-			&subscription.Price,
-			&subscription.Currency,
-			&subscription.ProductCode,
-			&subscription.Status,
-			&subscription.BilledCycles,
-			&subscription.NextBillingDate,
-			&subscription.CreatedAt,
-			&subscription.UpdatedAt,
-		)
-		if err != nil {
-			log.Println("Error scanning", err)
-			return nil, err
-		}
-
-		subscriptions = append(subscriptions, &subscription)
-	}
-
-	return subscriptions, nil
+// WithTx returns a SubscriptionPersistence that runs its statements in the unit of work's transaction tx
+func (s *SubscriptionPersistence) WithTx(tx *sql.Tx) SubscriptionPersistence {
+	return SubscriptionPersistence{db: tx}
 }
 
-// GetByUserID returns one subscription by UserID
-func (s *SubscriptionPersistence) GetByUserID(userID int) (*models.Subscription, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `SELECT * FROM subscriptions WHERE user_id = $1`
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
+// scanSubscription reads one row selected with subscriptionColumns
+func scanSubscription(row rowScanner) (*models.Subscription, error) {
 	var subscription models.Subscription
-	row := s.db.QueryRowContext(ctx, query, userID)
+	var price, currency string
+	var canceledAt, trialEndsAt sql.NullTime
 
 	err := row.Scan(
 		&subscription.ID,
@@ -82,104 +61,130 @@ func (s *SubscriptionPersistence) GetByUserID(userID int) (*models.Subscription,
 		&subscription.DurationUnits,
 		&subscription.BillingFrequency,
 		&subscription.BillingFrequencyUnits,
-		&subscription.Price,
-		&subscription.Currency,
+		&price,
+		&currency,
 		&subscription.ProductCode,
 		&subscription.Status,
 		&subscription.BilledCycles,
 		&subscription.NextBillingDate,
 		&subscription.CreatedAt,
 		&subscription.UpdatedAt,
+		&subscription.CancelAtPeriodEnd,
+		&canceledAt,
+		&subscription.SkippedCycles,
+		&subscription.PausedCycles,
+		&trialEndsAt,
 	)
+	if err != nil {
+		return nil, err
+	}
 
+	subscription.Price, err = money.Parse(price, currency)
 	if err != nil {
 		return nil, err
 	}
 
+	if canceledAt.Valid {
+		subscription.CanceledAt = &canceledAt.Time
+	}
+	if trialEndsAt.Valid {
+		subscription.TrialEndsAt = &trialEndsAt.Time
+	}
+
 	return &subscription, nil
 }
 
-// GetOne returns one subscription by ID
-func (s *SubscriptionPersistence) GetOne(id int) (*models.Subscription, error) {
+// scanSubscriptions reads all rows selected with subscriptionColumns
+func scanSubscriptions(rows *sql.Rows) ([]*models.Subscription, error) {
+	var subscriptions []*models.Subscription
+
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// subscriptionSortFields are the fields subscription lists can be ordered by
+var subscriptionSortFields = map[string]sortField[*models.Subscription]{
+	"id":     {column: "id", cast: "integer", value: func(s *models.Subscription) string { return fmt.Sprint(s.ID) }},
+	"status": {column: "status", cast: "text", value: func(s *models.Subscription) string { return s.Status }},
+	"price":  {column: "price", cast: "numeric", value: func(s *models.Subscription) string { return s.Price.String() }},
+	"next_billing_date": {column: "next_billing_date", cast: "timestamp", value: func(s *models.Subscription) string {
+		return s.NextBillingDate.Format(time.RFC3339Nano)
+	}},
+	"contract_start_date": {column: "contract_start_date", cast: "timestamp", value: func(s *models.Subscription) string {
+		return s.ContractStartDate.Format(time.RFC3339Nano)
+	}},
+}
+
+// List returns one page of the subscriptions matching the filter. It returns ErrInvalidSort or
+// ErrInvalidCursor for pages that cannot be listed.
+func (s *SubscriptionPersistence) List(filter models.SubscriptionFilter, page models.PageRequest) (models.Page[*models.Subscription], error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `SELECT * FROM subscriptions WHERE id = $1`
+	var f filters
+	if filter.Status != "" {
+		f.add("status = ?", filter.Status)
+	}
+	if filter.PlanID != 0 {
+		f.add("plan_id = ?", filter.PlanID)
+	}
+	if filter.Currency != "" {
+		f.add("currency = ?", filter.Currency)
+	}
+	if filter.ProductCode != "" {
+		f.add("product_code = ?", filter.ProductCode)
+	}
+	if !filter.NextBillingFrom.IsZero() {
+		f.add("next_billing_date >= ?", filter.NextBillingFrom)
+	}
+	if !filter.NextBillingTo.IsZero() {
+		f.add("next_billing_date < ?", filter.NextBillingTo.AddDate(0, 0, 1))
+	}
 
-	var subscription models.Subscription
-	row := s.db.QueryRowContext(ctx, query, id)
+	result, err := listPage(ctx, s.db, "subscriptions", subscriptionColumns, subscriptionSortFields, f, page,
+		func(s *models.Subscription) int { return s.ID }, scanSubscription)
+	if err != nil && !errors.Is(err, ErrInvalidSort) && !errors.Is(err, ErrInvalidCursor) {
+		log.Println("Error listing subscriptions:", err)
+	}
+	return result, err
+}
 
-	err := row.Scan(
-		&subscription.ID,
-		&subscription.UserID,
-		&subscription.PlanID,
-		&subscription.ContractStartDate,
-		&subscription.Duration,
-		&subscription.DurationUnits,
-		&subscription.BillingFrequency,
-		&subscription.BillingFrequencyUnits,
-		&subscription.Price,
-		&subscription.Currency,
-		&subscription.ProductCode,
-		&subscription.Status,
-		&subscription.BilledCycles,
-		&subscription.NextBillingDate,
-		&subscription.CreatedAt,
-		&subscription.UpdatedAt,
-	)
+// GetByUserID returns all subscriptions of the user, oldest first
+func (s *SubscriptionPersistence) GetByUserID(userID int) ([]*models.Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
 
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE user_id = $1 ORDER BY id`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &subscription, nil
+	return scanSubscriptions(rows)
 }
 
-// Update updates one subscription in the database, using the information stored in the receiver sub
-func (s *SubscriptionPersistence) Update(subscription models.Subscription) error {
+// GetOne returns one subscription by ID
+func (s *SubscriptionPersistence) GetOne(id int) (*models.Subscription, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `UPDATE subscriptions SET
-        user_id = $1,
-        plan_id = $2,
-        contract_start_date = $3,
-        duration = $4,
-        duration_units = $5,
-        billing_frequency = $6,
-        billing_frequency_units = $7,
-        price = $8,
-        currency = $9,
-        product_code = $10,
-        status = $11,
-        next_billing_date = $12,
-		updated_At = $13,
-        WHERE id = $14
-    `
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE id = $1`
 
-	_, err := s.db.ExecContext(ctx, stmt,
-		subscription.UserID,
-		subscription.PlanID,
-		subscription.ContractStartDate,
-		subscription.Duration,
-		subscription.DurationUnits,
-		subscription.BillingFrequency,
-		subscription.BillingFrequencyUnits,
-		subscription.Price,
-		subscription.Currency,
-		subscription.ProductCode,
-		subscription.Status,
-		&subscription.BilledCycles,
-		subscription.NextBillingDate,
-		time.Now(),
-		subscription.ID,
-	)
-
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return scanSubscription(s.db.QueryRowContext(ctx, query, id))
 }
 
 // Delete deletes one subscription from the database, by Subscription.ID
@@ -203,8 +208,8 @@ func (s *SubscriptionPersistence) AddSubscription(subscription models.Subscripti
 	defer cancel()
 
 	var newID int
-	stmt := `INSERT INTO subscriptions (user_id, plan_id, contract_start_date, duration, duration_units, billing_frequency, billing_frequency_units, price, currency, product_code, next_billing_date,status,created_at,updated_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id
+	stmt := `INSERT INTO subscriptions (user_id, plan_id, contract_start_date, duration, duration_units, billing_frequency, billing_frequency_units, price, currency, product_code, next_billing_date,status,created_at,updated_at,trial_ends_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id
     `
 
 	err := s.db.QueryRowContext(ctx, stmt,
@@ -215,15 +220,19 @@ func (s *SubscriptionPersistence) AddSubscription(subscription models.Subscripti
 		subscription.DurationUnits,
 		subscription.BillingFrequency,
 		subscription.BillingFrequencyUnits,
-		subscription.Price,
-		subscription.Currency,
+		subscription.Price.String(),
+		subscription.Price.Currency,
 		subscription.ProductCode,
 		subscription.NextBillingDate,
 		subscription.Status,
 		time.Now(),
 		time.Now(),
+		subscription.TrialEndsAt,
 	).Scan(&newID)
 
+	if isUniqueViolation(err, subscriptionUserPlanKey) {
+		return 0, ErrDuplicateSubscription
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -231,48 +240,254 @@ func (s *SubscriptionPersistence) AddSubscription(subscription models.Subscripti
 	return newID, nil
 }
 
-// GetSubscriptionsToBillToday returns subscriptions to be billed today.
-func (s *SubscriptionPersistence) GetSubscriptionsToBillToday() ([]*models.Subscription, error) {
+// GetSubscriptionsDue returns the subscriptions whose next billing date falls in [from, until) and that
+// have no invoice for that period yet: active ones to bill, paused ones whose pause is over and
+// trialing ones whose trial is over.
+// Passing a zero from catches up on every missed period.
+func (s *SubscriptionPersistence) GetSubscriptionsDue(from, until time.Time) ([]*models.Subscription, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
 	query := `
-        SELECT * FROM subscriptions
-        WHERE billed_cycles < billing_frequency
-        AND status = 'ACTIVE'
-        AND next_billing_date::date = $1
+        SELECT ` + subscriptionColumns + ` FROM subscriptions s
+        WHERE s.billed_cycles < s.billing_frequency
+        AND s.status IN ('ACTIVE', 'PAUSED', 'TRIALING')
+        AND s.next_billing_date >= $1
+        AND s.next_billing_date < $2
+        AND NOT EXISTS (
+            SELECT 1 FROM invoices i JOIN invoice_line_items li ON li.invoice_id = i.id
+            WHERE li.subscription_id = s.id AND i.period_start = s.next_billing_date AND i.kind = 'CYCLE'
+        )
+        ORDER BY s.next_billing_date, s.id
     `
 
-	rows, err := s.db.QueryContext(ctx, query, time.Now().Format("2006-01-02"))
+	rows, err := s.db.QueryContext(ctx, query, from, until)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var subscriptions []*models.Subscription
+	return scanSubscriptions(rows)
+}
+
+// GetTrialsEndingBefore returns the trialing subscriptions whose trial ends before until and whose
+// customer has not been reminded of the first charge yet. Subscriptions canceling at the end of the
+// trial are left out since they will not be charged.
+func (s *SubscriptionPersistence) GetTrialsEndingBefore(until time.Time) ([]*models.Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+        SELECT ` + subscriptionColumns + ` FROM subscriptions
+        WHERE status = 'TRIALING'
+        AND NOT cancel_at_period_end
+        AND trial_reminder_sent_at IS NULL
+        AND trial_ends_at < $1
+        ORDER BY trial_ends_at, id
+    `
+
+	rows, err := s.db.QueryContext(ctx, query, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSubscriptions(rows)
+}
 
+// MarkTrialReminderSent records that the customer was reminded of the end of the subscription's trial
+func (s *SubscriptionPersistence) MarkTrialReminderSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, "UPDATE subscriptions SET trial_reminder_sent_at = $1 WHERE id = $2", time.Now(), id)
+	if err != nil {
+		log.Println("Error marking trial reminder sent:", err)
+		return err
+	}
+	return nil
+}
+
+// Transition writes a lifecycle change of the subscription together with its audit event. The update
+// only applies if the subscription is still in the state change.From was loaded in, otherwise
+// ErrSubscriptionChanged is returned and nothing is written.
+func (s *SubscriptionPersistence) Transition(change models.SubscriptionChange, event models.SubscriptionEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := begin(ctx, s.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	updated, err := updateSubscription(ctx, tx, change)
+	if err != nil {
+		log.Println("Error updating subscription:", err)
+		return err
+	}
+	if !updated {
+		return ErrSubscriptionChanged
+	}
+
+	if err = addSubscriptionEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println("Error committing subscription transition:", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetEvents returns the audit trail of a subscription, oldest first
+func (s *SubscriptionPersistence) GetEvents(subscriptionID int) ([]models.SubscriptionEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `SELECT id, subscription_id, action, from_status, to_status, COALESCE(actor_id, 0), detail, created_at
+        FROM subscription_events WHERE subscription_id = $1 ORDER BY id`
+
+	rows, err := s.db.QueryContext(ctx, query, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.SubscriptionEvent
 	for rows.Next() {
-		var subscription models.Subscription
-		if err := rows.Scan(&subscription.ID,
-			&subscription.UserID,
-			&subscription.PlanID,
-			&subscription.ContractStartDate,
-			&subscription.Duration,
-			&subscription.DurationUnits,
-			&subscription.BillingFrequency,
-			&subscription.BillingFrequencyUnits,
-			&subscription.Price,
-			&subscription.Currency,
-			&subscription.ProductCode,
-			&subscription.Status,
-			&subscription.BilledCycles,
-			&subscription.NextBillingDate,
-			&subscription.CreatedAt,
-			&subscription.UpdatedAt); err != nil {
+		var event models.SubscriptionEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.SubscriptionID,
+			&event.Action,
+			&event.FromStatus,
+			&event.ToStatus,
+			&event.ActorID,
+			&event.Detail,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning subscription event:", err)
 			return nil, err
 		}
-		subscriptions = append(subscriptions, &subscription)
+		events = append(events, event)
 	}
 
-	return subscriptions, nil
+	return events, rows.Err()
+}
+
+// updateSubscription moves the subscription from change.From to change.To within tx. It reports false
+// when any column a lifecycle action or billing run changes (plan, status, billed, skipped and paused
+// cycles, next billing date or pending cancellation) no longer matches change.From, so a concurrent
+// change is never overwritten.
+func updateSubscription(ctx context.Context, tx DBTX, change models.SubscriptionChange) (bool, error) {
+	stmt := `UPDATE subscriptions SET
+        plan_id = $1,
+        contract_start_date = $2,
+        duration = $3,
+        duration_units = $4,
+        billing_frequency = $5,
+        billing_frequency_units = $6,
+        price = $7,
+        currency = $8,
+        product_code = $9,
+        status = $10,
+        billed_cycles = $11,
+        next_billing_date = $12,
+        cancel_at_period_end = $13,
+        canceled_at = $14,
+        skipped_cycles = $15,
+        paused_cycles = $16,
+        updated_at = $17
+        WHERE id = $18 AND plan_id = $19 AND status = $20 AND billed_cycles = $21
+        AND next_billing_date = $22 AND cancel_at_period_end = $23 AND skipped_cycles = $24 AND paused_cycles = $25
+    `
+
+	to := change.To
+	res, err := tx.ExecContext(ctx, stmt,
+		to.PlanID,
+		to.ContractStartDate,
+		to.Duration,
+		to.DurationUnits,
+		to.BillingFrequency,
+		to.BillingFrequencyUnits,
+		to.Price.String(),
+		to.Price.Currency,
+		to.ProductCode,
+		to.Status,
+		to.BilledCycles,
+		to.NextBillingDate,
+		to.CancelAtPeriodEnd,
+		to.CanceledAt,
+		to.SkippedCycles,
+		to.PausedCycles,
+		time.Now(),
+		to.ID,
+		change.From.PlanID,
+		change.From.Status,
+		change.From.BilledCycles,
+		change.From.NextBillingDate,
+		change.From.CancelAtPeriodEnd,
+		change.From.SkippedCycles,
+		change.From.PausedCycles,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// addSubscriptionEvent appends an entry to the subscription audit trail within tx
+func addSubscriptionEvent(ctx context.Context, tx DBTX, event models.SubscriptionEvent) error {
+	stmt := `INSERT INTO subscription_events (subscription_id, action, from_status, to_status, actor_id, detail, created_at)
+        VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7)
+    `
+
+	_, err := tx.ExecContext(ctx, stmt,
+		event.SubscriptionID,
+		event.Action,
+		event.FromStatus,
+		event.ToStatus,
+		event.ActorID,
+		event.Detail,
+		time.Now(),
+	)
+	if err != nil {
+		log.Println("Error inserting subscription event:", err)
+		return err
+	}
+
+	return nil
+}
+
+// changeEvent returns the audit event for a subscription change made by billing, and false when the
+// change is a plain cycle advance that does not need one.
+func changeEvent(change models.SubscriptionChange) (models.SubscriptionEvent, bool) {
+	event := models.SubscriptionEvent{
+		SubscriptionID: change.To.ID,
+		FromStatus:     change.From.Status,
+		ToStatus:       change.To.Status,
+	}
+
+	switch {
+	case change.From.PlanID != change.To.PlanID:
+		event.Action = states.SUBSCRIPTION_CHANGE_PLAN
+		event.Detail = fmt.Sprintf("plan %d -> %d", change.From.PlanID, change.To.PlanID)
+	case change.From.Status != change.To.Status:
+		event.Action = states.SUBSCRIPTION_BILL
+		event.Detail = fmt.Sprintf("billed cycle %d of %d", change.To.BilledCycles, change.To.BillingFrequency)
+	default:
+		return event, false
+	}
+
+	return event, true
 }
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"subscription-service/internal/pkg/money"
+)
+
+// ErrNoTaxRate is returned when no VAT rate is configured for a country
+var ErrNoTaxRate = errors.New("no tax rate configured for country")
+
+type TaxRatePersistence struct {
+	db *sql.DB
+}
+
+// NewTaxRatePersistence is the function used to create an instance of the TaxRatePersistence.
+func NewTaxRatePersistence(dbPool *sql.DB) TaxRatePersistence {
+	return TaxRatePersistence{db: dbPool}
+}
+
+// GetRate returns the VAT rate of the country for the product code, falling back to the
+// country's standard rate when the product has no reduced rate
+func (p *TaxRatePersistence) GetRate(country, productCode string) (money.Percent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `SELECT rate FROM tax_rates WHERE country = $1 AND product_code IN ($2, '')
+        ORDER BY product_code DESC LIMIT 1`
+
+	var rate string
+	err := p.db.QueryRowContext(ctx, query, country, productCode).Scan(&rate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNoTaxRate
+	}
+	if err != nil {
+		log.Println("Error querying tax rate:", err)
+		return 0, err
+	}
+
+	return money.ParsePercent(rate)
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// DBTX is the part of *sql.DB and *sql.Tx the persistence types use, so that they can run either on
+// the connection pool or inside a unit of work
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// UnitOfWork runs a group of writes in a single transaction. Persistence types bound to the
+// transaction with WithTx commit or roll back together.
+type UnitOfWork struct {
+	db *sql.DB
+}
+
+// NewUnitOfWork is the function used to create an instance of the UnitOfWork.
+func NewUnitOfWork(dbPool *sql.DB) UnitOfWork {
+	return UnitOfWork{db: dbPool}
+}
+
+// Do calls fn with a new transaction and commits it if fn returns nil. Any error rolls the whole
+// transaction back and is returned unchanged.
+func (u *UnitOfWork) Do(fn func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// transaction is a transaction started by a persistence method
+type transaction interface {
+	DBTX
+	Commit() error
+	Rollback() error
+}
+
+// begin starts a transaction on conn. When conn already is a unit of work's transaction, the returned
+// transaction is a savepoint within it: committing releases the savepoint and leaves the final commit
+// to the unit of work, rolling back undoes only the writes made since begin.
+func begin(ctx context.Context, conn DBTX) (transaction, error) {
+	switch c := conn.(type) {
+	case *sql.DB:
+		tx, err := c.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	case *sql.Tx:
+		return newSavepoint(ctx, c)
+	default:
+		return nil, fmt.Errorf("cannot start a transaction on %T", conn)
+	}
+}
+
+var savepoints atomic.Int64
+
+// savepoint is a nested transaction inside a unit of work
+type savepoint struct {
+	*sql.Tx
+	ctx  context.Context
+	name string
+	done bool
+}
+
+func newSavepoint(ctx context.Context, tx *sql.Tx) (*savepoint, error) {
+	sp := &savepoint{Tx: tx, ctx: ctx, name: fmt.Sprintf("sp_%d", savepoints.Add(1))}
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+sp.name); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// Commit releases the savepoint, keeping its writes in the enclosing transaction
+func (sp *savepoint) Commit() error {
+	if sp.done {
+		return errors.New("savepoint already finished")
+	}
+	sp.done = true
+	_, err := sp.Tx.ExecContext(sp.ctx, "RELEASE SAVEPOINT "+sp.name)
+	return err
+}
+
+// Rollback undoes the writes made since the savepoint; it does nothing after Commit
+func (sp *savepoint) Rollback() error {
+	if sp.done {
+		return nil
+	}
+	sp.done = true
+	_, err := sp.Tx.ExecContext(sp.ctx, "ROLLBACK TO SAVEPOINT "+sp.name)
+	return err
+}
@@ -5,13 +5,14 @@ import (
 	"database/sql"
 	"log"
 	"subscription-service/internal/constants/models"
+	"subscription-service/internal/constants/states"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type UserPersistence struct {
-	db *sql.DB
+	db DBTX
 }
 
 // NewUsersPersistence is the function used to create an instance of the UserPersistence.
@@ -19,12 +20,17 @@ func NewUsersPersistence(dbPool *sql.DB) UserPersistence {
 	return UserPersistence{db: dbPool}
 }
 
+// WithTx returns a UserPersistence that runs its statements in the unit of work's transaction tx
+func (u *UserPersistence) WithTx(tx *sql.Tx) UserPersistence {
+	return UserPersistence{db: tx}
+}
+
 // GetAll returns a slice of all users, sorted by last name
 func (u *UserPersistence) GetAll() ([]*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, active, created_at, updated_at
+	query := `select id, email, first_name, last_name, password, role, active, created_at, updated_at
 	from users order by last_name`
 
 	rows, err := u.db.QueryContext(ctx, query)
@@ -43,6 +49,7 @@ func (u *UserPersistence) GetAll() ([]*models.User, error) {
 			&user.FirstName,
 			&user.LastName,
 			&user.Password,
+			&user.Role,
 			&user.Active,
 			&user.CreatedAt,
 			&user.UpdatedAt,
@@ -63,7 +70,7 @@ func (u *UserPersistence) GetByEmail(email string) (*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, active, created_at, updated_at from users where email = $1`
+	query := `select id, email, first_name, last_name, password, role, active, created_at, updated_at from users where email = $1`
 
 	var user models.User
 	row := u.db.QueryRowContext(ctx, query, email)
@@ -74,6 +81,7 @@ func (u *UserPersistence) GetByEmail(email string) (*models.User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
+		&user.Role,
 		&user.Active,
 		&user.CreatedAt,
 		&user.UpdatedAt,
@@ -91,7 +99,7 @@ func (u *UserPersistence) GetOne(id int) (*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, role, active, created_at, updated_at from users where id = $1`
 
 	var user models.User
 	row := u.db.QueryRowContext(ctx, query, id)
@@ -102,6 +110,7 @@ func (u *UserPersistence) GetOne(id int) (*models.User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
+		&user.Role,
 		&user.Active,
 		&user.CreatedAt,
 		&user.UpdatedAt,
@@ -170,15 +179,21 @@ func (u *UserPersistence) AddUser(user models.User) (int, error) {
 		return 0, err
 	}
 
+	role := user.Role
+	if role == "" {
+		role = states.ROLE_CUSTOMER
+	}
+
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, role, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
 	err = u.db.QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
+		role,
 		user.Active,
 		time.Now(),
 		time.Now(),
@@ -216,11 +231,11 @@ func (u *UserPersistence) AddBillingAddress(address models.Address) (int, error)
 	defer cancel()
 
 	var newID int
-	stmt := `INSERT INTO billing_address (user_id, address, address_2, postal_code, city, country)
-        VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+	stmt := `INSERT INTO billing_address (user_id, address, address_2, postal_code, city, country, vat_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id
     `
 
-	err := u.db.QueryRowContext(ctx, stmt, address.UserID, address.Address, address.Address2, address.PostalCode, address.PostalCode, address.PostalCode).Scan(&newID)
+	err := u.db.QueryRowContext(ctx, stmt, address.UserID, address.Address, address.Address2, address.PostalCode, address.City, address.Country, address.VatID).Scan(&newID)
 	if err != nil {
 		return 0, err
 	}
@@ -233,12 +248,12 @@ func (u *UserPersistence) GetBillingAddressByUserID(userID int) (*models.Address
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `SELECT id, address, address_2, postal_code, city, country FROM billing_address WHERE user_id = $1`
+	query := `SELECT id, user_id, address, address_2, postal_code, city, country, vat_id FROM billing_address WHERE user_id = $1`
 
 	var billingAddress models.Address
 	row := u.db.QueryRowContext(ctx, query, userID)
 
-	err := row.Scan(&billingAddress.ID, &billingAddress.Address, &billingAddress.Address2, &billingAddress.PostalCode, &billingAddress.City, &billingAddress.Country)
+	err := row.Scan(&billingAddress.ID, &billingAddress.UserID, &billingAddress.Address, &billingAddress.Address2, &billingAddress.PostalCode, &billingAddress.City, &billingAddress.Country, &billingAddress.VatID)
 	if err != nil {
 		return nil, err
 	}
@@ -13,7 +13,7 @@ type Route struct {
 	Method      string
 	Path        string
 	Handle      http.HandlerFunc
-	MiddleWares []http.HandlerFunc
+	MiddleWares []func(http.Handler) http.Handler
 }
 
 func Routes(routes []Route) http.Handler {
@@ -24,7 +24,7 @@ func Routes(routes []Route) http.Handler {
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "Content-Disposition", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -32,7 +32,7 @@ func Routes(routes []Route) http.Handler {
 	mux.Use(middleware.Heartbeat("/ping"))
 
 	for _, route := range routes {
-		mux.Method(route.Method, route.Path, route.Handle)
+		mux.With(route.MiddleWares...).Method(route.Method, route.Path, route.Handle)
 	}
 	return mux
 }